@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	upnp "github.com/sberk42/fritzbox_exporter/fritzbox_upnp"
+	"github.com/sirupsen/logrus"
+)
+
+// delays before calling an action again after internal errors or failed authentication, doubled for each failure
+const (
+	backoffInitialDelay = 30 * time.Second
+	backoffMaxDelay     = 30 * time.Minute
+)
+
+// errActionSkipped is wrapped by the errors of actions not called because of previous errors
+var errActionSkipped = errors.New("action skipped")
+
+var errActionDisabled = fmt.Errorf("%w: not supported by the FRITZ!Box", errActionSkipped)
+
+type actionBackoff struct {
+	until time.Time
+	delay time.Duration
+}
+
+// actionStatus actions which must not be called (for now) because of previous errors, keyed by service|action
+type actionStatus struct {
+	sync.Mutex
+	disabled map[string]bool
+	backoff  map[string]*actionBackoff
+	auth     *actionBackoff // failed authentication, applies to all actions of the FRITZ!Box
+}
+
+func newActionStatus() *actionStatus {
+	return &actionStatus{
+		disabled: make(map[string]bool),
+		backoff:  make(map[string]*actionBackoff),
+	}
+}
+
+// check returns an error wrapping errActionSkipped if the action must not be called now
+func (as *actionStatus) check(key string, now time.Time) error {
+	as.Lock()
+	defer as.Unlock()
+
+	if as.disabled[key] {
+		return errActionDisabled
+	}
+
+	if as.auth != nil && now.Before(as.auth.until) {
+		return fmt.Errorf("%w: authentication failed, backing off until %s", errActionSkipped, as.auth.until.Format(time.RFC3339))
+	}
+
+	if b, ok := as.backoff[key]; ok && now.Before(b.until) {
+		return fmt.Errorf("%w: backing off until %s", errActionSkipped, b.until.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// next doubles the delay and returns the time until which calls must not be made
+func (b *actionBackoff) next(now time.Time) time.Time {
+	b.delay *= 2
+	if b.delay > backoffMaxDelay {
+		b.delay = backoffMaxDelay
+	}
+	b.until = now.Add(b.delay)
+
+	return b.until
+}
+
+// update disables the action if the FRITZ!Box does not support it and backs off on internal errors of the action,
+// failed authentication stops all actions (to prevent the FRITZ!Box from blocking the login), a successful call resets
+// the backoff
+func (as *actionStatus) update(key string, err error, now time.Time) {
+	as.Lock()
+	defer as.Unlock()
+
+	if err == nil {
+		delete(as.backoff, key)
+		as.auth = nil
+		return
+	}
+
+	var sfe *upnp.SoapFaultError
+	var ae *upnp.AuthError
+	isFault := errors.As(err, &sfe)
+
+	switch {
+	case isFault && sfe.Code == upnp.ErrorCodeInvalidAction:
+		logrus.Warnf("disabling %s: %s", key, err)
+		as.disabled[key] = true
+
+	case isFault && sfe.Code == upnp.ErrorCodeInternalError:
+		b, ok := as.backoff[key]
+		if !ok {
+			b = &actionBackoff{delay: backoffInitialDelay / 2}
+			as.backoff[key] = b
+		}
+		b.next(now)
+
+		logrus.Warnf("backing off %s for %s: %s", key, b.delay, err)
+
+	case errors.As(err, &ae):
+		if as.auth == nil {
+			as.auth = &actionBackoff{delay: backoffInitialDelay / 2}
+		} else if now.Before(as.auth.until) {
+			// concurrent call started before the backoff, the delay was already doubled
+			return
+		}
+		as.auth.next(now)
+
+		logrus.Warnf("backing off all actions for %s: %s", as.auth.delay, err)
+	}
+}
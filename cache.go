@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// interval for removing expired entries, so results of vanished index entries don't stay forever
+const cachePurgeInterval = 5 * time.Minute
+
+// cacheMetrics metrics of all caches of one kind (upnp or lua)
+type cacheMetrics struct {
+	cached  prometheus.Counter
+	loaded  prometheus.Counter
+	shared  prometheus.Counter
+	entries prometheus.Gauge
+}
+
+func newCacheMetrics(cache string) *cacheMetrics {
+	labels := prometheus.Labels{"Cache": cache}
+
+	return &cacheMetrics{
+		cached: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "fritzbox_exporter_results_cached",
+			Help:        "Number of results taken from cache.",
+			ConstLabels: labels,
+		}),
+		loaded: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "fritzbox_exporter_results_loaded",
+			Help:        "Number of results loaded from fritzbox.",
+			ConstLabels: labels,
+		}),
+		shared: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "fritzbox_exporter_results_shared",
+			Help:        "Number of results shared with a concurrent load of the same result.",
+			ConstLabels: labels,
+		}),
+		entries: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "fritzbox_exporter_cache_entries",
+			Help:        "Number of results currently in cache.",
+			ConstLabels: labels,
+		}),
+	}
+}
+
+func (cm *cacheMetrics) register() {
+	prometheus.MustRegister(cm.cached)
+	prometheus.MustRegister(cm.loaded)
+	prometheus.MustRegister(cm.shared)
+	prometheus.MustRegister(cm.entries)
+}
+
+var (
+	upnpCacheMetrics = newCacheMetrics("UPNP")
+	luaCacheMetrics  = newCacheMetrics("LUA")
+)
+
+type cacheEntry struct {
+	expires time.Time
+	value   interface{}
+}
+
+// cacheLoad a load in progress, concurrent gets for the same key wait for it
+type cacheLoad struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// resultCache thread-safe cache for results, concurrent gets of a missing key only load it once
+type resultCache struct {
+	metrics *cacheMetrics
+
+	sync.Mutex
+	entries   map[string]*cacheEntry
+	loads     map[string]*cacheLoad
+	lastPurge time.Time
+}
+
+func newResultCache(metrics *cacheMetrics) *resultCache {
+	return &resultCache{
+		metrics:   metrics,
+		entries:   make(map[string]*cacheEntry),
+		loads:     make(map[string]*cacheLoad),
+		lastPurge: time.Now(),
+	}
+}
+
+// get returns the cached value for key if it is not older than ttl seconds, otherwise the value is loaded.
+// Errors are not cached.
+func (c *resultCache) get(key string, ttl int64, load func() (interface{}, error)) (interface{}, error) {
+	now := time.Now()
+
+	c.Lock()
+	if entry, ok := c.entries[key]; ok && !now.After(entry.expires) {
+		c.Unlock()
+		c.metrics.cached.Inc()
+		return entry.value, nil
+	}
+
+	if l, ok := c.loads[key]; ok {
+		c.Unlock()
+		<-l.done
+		c.metrics.shared.Inc()
+		return l.value, l.err
+	}
+
+	l := &cacheLoad{done: make(chan struct{})}
+	c.loads[key] = l
+	c.Unlock()
+
+	// if load panics the waiting gets fail and the panic continues, so the key can be loaded again
+	defer func() {
+		if r := recover(); r != nil {
+			l.value, l.err = nil, fmt.Errorf("loading %s failed: %v", key, r)
+
+			c.Lock()
+			delete(c.loads, key)
+			c.Unlock()
+
+			close(l.done)
+			panic(r)
+		}
+	}()
+
+	l.value, l.err = load()
+
+	c.Lock()
+	delete(c.loads, key)
+	if l.err == nil {
+		if _, ok := c.entries[key]; !ok {
+			c.metrics.entries.Inc()
+		}
+		c.entries[key] = &cacheEntry{expires: now.Add(time.Duration(ttl) * time.Second), value: l.value}
+		c.metrics.loaded.Inc()
+	}
+	c.purge(now)
+	c.Unlock()
+
+	close(l.done)
+
+	return l.value, l.err
+}
+
+// remove drops the entry for key, e.g. if the result turned out to be invalid
+func (c *resultCache) remove(key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, ok := c.entries[key]; ok {
+		delete(c.entries, key)
+		c.metrics.entries.Dec()
+	}
+}
+
+// purge removes expired entries, must be called with lock held
+func (c *resultCache) purge(now time.Time) {
+	if now.Sub(c.lastPurge) < cachePurgeInterval {
+		return
+	}
+	c.lastPurge = now
+
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+			c.metrics.entries.Dec()
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	upnp "github.com/sberk42/fritzbox_exporter/fritzbox_upnp"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	onTelService = "urn:dslforum-org:service:X_AVM-DE_OnTel:1"
+	tamService   = "urn:dslforum-org:service:X_AVM-DE_TAM:1"
+
+	// TTL for the call list and messages, the lists are loaded as documents which is expensive for the FRITZ!Box
+	callListTTL = 60
+)
+
+// types of calls in the call list, active calls are counted once they are finished
+const (
+	callTypeIncoming       = 1
+	callTypeMissed         = 2
+	callTypeOutgoing       = 3
+	callTypeActiveIncoming = 9
+	callTypeRejected       = 10
+	callTypeActiveOutgoing = 11
+)
+
+var callTypeNames = map[int]string{
+	callTypeIncoming: "incoming",
+	callTypeMissed:   "missed",
+	callTypeOutgoing: "outgoing",
+	callTypeRejected: "rejected",
+}
+
+// buckets of the call duration, the FRITZ!Box only reports minutes
+var callDurationBuckets = []float64{60, 120, 300, 600, 1200, 1800, 3600, 7200}
+
+var (
+	callsDesc = prometheus.NewDesc(
+		"gateway_calls_total",
+		"Number of finished calls by type (incoming, outgoing, missed, rejected), port and own number (line).",
+		[]string{"gateway", "type", "port", "line"},
+		nil,
+	)
+	callDurationDesc = prometheus.NewDesc(
+		"gateway_call_duration_seconds",
+		"Duration of incoming and outgoing calls.",
+		[]string{"gateway", "type"},
+		nil,
+	)
+	callLastIDDesc = prometheus.NewDesc(
+		"gateway_call_list_last_id",
+		"Highest ID of the finished calls counted.",
+		[]string{"gateway"},
+		nil,
+	)
+	tamEnabledDesc = prometheus.NewDesc(
+		"gateway_tam_enabled",
+		"Whether the answering machine is enabled.",
+		[]string{"gateway", "tam", "name"},
+		nil,
+	)
+	tamMessagesDesc = prometheus.NewDesc(
+		"gateway_tam_messages",
+		"Number of messages on the answering machine.",
+		[]string{"gateway", "tam", "name"},
+		nil,
+	)
+	tamUnreadDesc = prometheus.NewDesc(
+		"gateway_tam_messages_unread",
+		"Number of new messages on the answering machine.",
+		[]string{"gateway", "tam", "name"},
+		nil,
+	)
+)
+
+// callList document returned by the URL of GetCallList
+type callList struct {
+	Calls []*callEntry `xml:"Call"`
+}
+
+type callEntry struct {
+	ID           int    `xml:"Id"`
+	Type         int    `xml:"Type"`
+	Port         string `xml:"Port"`
+	CalledNumber string `xml:"CalledNumber"` // own number of incoming calls
+	CallerNumber string `xml:"CallerNumber"` // own number of outgoing calls
+	Duration     string `xml:"Duration"`     // h:mm
+}
+
+// tamList result NewTAMList of GetList
+type tamList struct {
+	Items []*tamItem `xml:"Item"`
+}
+
+type tamItem struct {
+	Index   int    `xml:"Index"`
+	Display bool   `xml:"Display"`
+	Enable  bool   `xml:"Enable"`
+	Name    string `xml:"Name"`
+}
+
+// tamMessageList document returned by the URL of GetMessageList
+type tamMessageList struct {
+	Messages []*tamMessage `xml:"Message"`
+}
+
+type tamMessage struct {
+	Index int  `xml:"Index"`
+	New   bool `xml:"New"`
+}
+
+type callKey struct {
+	callType string
+	port     string
+	line     string
+}
+
+// callDurations histogram of the call durations of a call type
+type callDurations struct {
+	count   uint64
+	sum     float64
+	buckets map[float64]uint64
+}
+
+// callCollector counts the calls of the call list and reports the messages of the answering machines.
+// Counters only contain calls with IDs higher than the highest ID counted before, so they stay monotonic even if calls
+// are removed from the list.
+type callCollector struct {
+	sync.Mutex
+	loaded    bool // call list loaded once
+	lastID    int
+	calls     map[callKey]uint64
+	durations map[string]*callDurations
+}
+
+func newCallCollector() subCollector {
+	return &callCollector{
+		calls:     make(map[callKey]uint64),
+		durations: make(map[string]*callDurations),
+	}
+}
+
+func (cc *callCollector) collect(fc *FritzboxCollector, sc *scrape, ch chan<- prometheus.Metric) {
+	doc, err := fc.getDocument(sc, onTelService, "GetCallList", "CallListURL", callListTTL)
+	if err == nil {
+		var list *callList
+		list, err = parseCallList(doc)
+		if err != nil {
+			sc.stats.record(onTelService, "GetCallList", 0, err, "")
+		} else {
+			cc.count(list)
+		}
+	}
+	logCollectError("call list", err)
+
+	cc.report(fc.Gateway, ch)
+	cc.collectTAMs(fc, sc, ch)
+}
+
+// parseCallList parses the call list document
+func parseCallList(doc []byte) (*callList, error) {
+	var list callList
+	err := xml.Unmarshal(doc, &list)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing call list: %w", err)
+	}
+
+	return &list, nil
+}
+
+// count adds the finished calls with IDs higher than the last ID in order of their IDs.
+// Counting stops at the first active call, so it is counted once it is finished.
+func (cc *callCollector) count(list *callList) {
+	sort.Slice(list.Calls, func(i, j int) bool { return list.Calls[i].ID < list.Calls[j].ID })
+
+	cc.Lock()
+	defer cc.Unlock()
+
+	cc.loaded = true
+	for _, call := range list.Calls {
+		if call.ID <= cc.lastID {
+			continue
+		}
+
+		if call.Type == callTypeActiveIncoming || call.Type == callTypeActiveOutgoing {
+			break
+		}
+
+		cc.lastID = call.ID
+
+		callType, ok := callTypeNames[call.Type]
+		if !ok {
+			continue
+		}
+
+		line := call.CalledNumber
+		if call.Type == callTypeOutgoing {
+			line = call.CallerNumber
+		}
+		cc.calls[callKey{callType: callType, port: call.Port, line: line}]++
+
+		if call.Type == callTypeIncoming || call.Type == callTypeOutgoing {
+			duration, err := parseDurationSeconds(call.Duration)
+			if err != nil {
+				logrus.Debugf("call %d has invalid duration %s", call.ID, call.Duration)
+				continue
+			}
+			cc.observe(callType, duration)
+		}
+	}
+}
+
+// observe adds the duration to the histogram of the call type, must be called with lock held
+func (cc *callCollector) observe(callType string, duration float64) {
+	d, ok := cc.durations[callType]
+	if !ok {
+		d = &callDurations{buckets: make(map[float64]uint64)}
+		for _, b := range callDurationBuckets {
+			d.buckets[b] = 0
+		}
+		cc.durations[callType] = d
+	}
+
+	d.count++
+	d.sum += duration
+	for _, b := range callDurationBuckets {
+		if duration <= b {
+			d.buckets[b]++
+		}
+	}
+}
+
+func (cc *callCollector) report(gateway string, ch chan<- prometheus.Metric) {
+	cc.Lock()
+	defer cc.Unlock()
+
+	if !cc.loaded {
+		return
+	}
+
+	for key, count := range cc.calls {
+		ch <- prometheus.MustNewConstMetric(callsDesc, prometheus.CounterValue, float64(count), gateway, key.callType, key.port, key.line)
+	}
+
+	for callType, d := range cc.durations {
+		buckets := make(map[float64]uint64, len(d.buckets))
+		for b, n := range d.buckets {
+			buckets[b] = n
+		}
+		ch <- prometheus.MustNewConstHistogram(callDurationDesc, d.count, d.sum, buckets, gateway, callType)
+	}
+
+	ch <- prometheus.MustNewConstMetric(callLastIDDesc, prometheus.GaugeValue, float64(cc.lastID), gateway)
+}
+
+// collectTAMs reports the number of messages and new messages of all answering machines shown in the UI
+func (cc *callCollector) collectTAMs(fc *FritzboxCollector, sc *scrape, ch chan<- prometheus.Metric) {
+	result, err := fc.getActionResult(sc, tamService, "GetList", callListTTL)
+	if err != nil {
+		logCollectError("answering machines", err)
+		return
+	}
+
+	list, err := parseTAMList(fmt.Sprintf("%v", result["TAMList"]))
+	if err != nil {
+		sc.stats.record(tamService, "GetList", 0, err, "")
+		logCollectError("answering machines", err)
+		return
+	}
+
+	for _, tam := range list.Items {
+		if !tam.Display {
+			continue
+		}
+
+		index := strconv.Itoa(tam.Index)
+		enabled := 0.0
+		if tam.Enable {
+			enabled = 1
+		}
+		ch <- prometheus.MustNewConstMetric(tamEnabledDesc, prometheus.GaugeValue, enabled, fc.Gateway, index, tam.Name)
+
+		doc, err := fc.getDocument(sc, tamService, "GetMessageList", "URL", callListTTL, &upnp.ActionArgument{Name: "NewIndex", Value: tam.Index})
+		if err != nil {
+			logCollectError("messages of answering machine "+index, err)
+			continue
+		}
+
+		messages, err := parseTAMMessageList(doc)
+		if err != nil {
+			sc.stats.record(tamService, "GetMessageList", 0, err, "")
+			logCollectError("messages of answering machine "+index, err)
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(tamMessagesDesc, prometheus.GaugeValue, float64(len(messages.Messages)), fc.Gateway, index, tam.Name)
+		ch <- prometheus.MustNewConstMetric(tamUnreadDesc, prometheus.GaugeValue, float64(messages.unread()), fc.Gateway, index, tam.Name)
+	}
+}
+
+// parseTAMList parses the list of answering machines
+func parseTAMList(data string) (*tamList, error) {
+	var list tamList
+	err := xml.Unmarshal([]byte(data), &list)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing answering machine list: %w", err)
+	}
+
+	return &list, nil
+}
+
+// parseTAMMessageList parses the message list document of an answering machine
+func parseTAMMessageList(doc []byte) (*tamMessageList, error) {
+	var list tamMessageList
+	err := xml.Unmarshal(doc, &list)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing message list: %w", err)
+	}
+
+	return &list, nil
+}
+
+// unread returns the number of new messages
+func (l *tamMessageList) unread() int {
+	unread := 0
+	for _, m := range l.Messages {
+		if m.New {
+			unread++
+		}
+	}
+	return unread
+}
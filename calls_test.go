@@ -0,0 +1,228 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func loadCallList(t *testing.T) *callList {
+	t.Helper()
+
+	list, err := parseCallList(readFixture(t, "calllist.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func TestParseCallList(t *testing.T) {
+	list := loadCallList(t)
+	if len(list.Calls) != 7 {
+		t.Fatalf("got %d calls, want 7", len(list.Calls))
+	}
+
+	tests := []struct {
+		index int
+		want  callEntry
+	}{
+		{0, callEntry{ID: 7, Type: callTypeActiveIncoming, Port: "1", CalledNumber: "12345", Duration: "0:00"}},
+		{1, callEntry{ID: 6, Type: callTypeOutgoing, Port: "1", CalledNumber: "0301111", CallerNumber: "12345", Duration: "0:05"}},
+		{4, callEntry{ID: 3, Type: callTypeIncoming, Port: "1", CalledNumber: "12345", Duration: "1:02"}},
+	}
+	for _, tt := range tests {
+		if got := *list.Calls[tt.index]; got != tt.want {
+			t.Errorf("call %d: got %+v, want %+v", tt.index, got, tt.want)
+		}
+	}
+
+	if _, err := parseCallList([]byte("<root><Call><Id>x</Id></Call></root>")); err == nil {
+		t.Error("invalid call list: got no error")
+	}
+}
+
+func TestParseTAMList(t *testing.T) {
+	list, err := parseTAMList(string(readFixture(t, "tamlist.xml")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []tamItem{
+		{Index: 0, Display: true, Enable: true, Name: "Anrufbeantworter 1"},
+		{Index: 1, Display: true, Enable: false, Name: "Anrufbeantworter 2"},
+		{Index: 2, Display: false, Enable: false, Name: ""},
+	}
+	if len(list.Items) != len(want) {
+		t.Fatalf("got %d answering machines, want %d", len(list.Items), len(want))
+	}
+	for i, w := range want {
+		if *list.Items[i] != w {
+			t.Errorf("answering machine %d: got %+v, want %+v", i, *list.Items[i], w)
+		}
+	}
+
+	if _, err := parseTAMList("<List><Item>"); err == nil {
+		t.Error("invalid answering machine list: got no error")
+	}
+}
+
+func TestParseTAMMessageList(t *testing.T) {
+	tests := []struct {
+		name     string
+		doc      string
+		messages int
+		unread   int
+	}{
+		{"fixture", string(readFixture(t, "tammessages.xml")), 3, 2},
+		{"empty", "<Root></Root>", 0, 0},
+		{"all read", "<Root><Message><Index>0</Index><New>0</New></Message></Root>", 1, 0},
+	}
+
+	for _, tt := range tests {
+		list, err := parseTAMMessageList([]byte(tt.doc))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(list.Messages) != tt.messages {
+			t.Errorf("%s: got %d messages, want %d", tt.name, len(list.Messages), tt.messages)
+		}
+		if got := list.unread(); got != tt.unread {
+			t.Errorf("%s: got %d unread, want %d", tt.name, got, tt.unread)
+		}
+	}
+}
+
+func TestCallCollectorCount(t *testing.T) {
+	cc := newCallCollector().(*callCollector)
+	cc.count(loadCallList(t))
+
+	tests := []struct {
+		key  callKey
+		want uint64
+	}{
+		{callKey{"incoming", "1", "12345"}, 1},
+		{callKey{"incoming", "2", "67890"}, 1},
+		{callKey{"outgoing", "1", "12345"}, 2},
+		{callKey{"missed", "1", "12345"}, 1},
+		{callKey{"rejected", "2", "12345"}, 1},
+	}
+	for _, tt := range tests {
+		if got := cc.calls[tt.key]; got != tt.want {
+			t.Errorf("%+v: got %d calls, want %d", tt.key, got, tt.want)
+		}
+	}
+	if len(cc.calls) != len(tests) {
+		t.Errorf("got %d counters, want %d", len(cc.calls), len(tests))
+	}
+
+	// the active call 7 is not counted yet
+	if cc.lastID != 6 {
+		t.Errorf("got last ID %d, want 6", cc.lastID)
+	}
+
+	durations := []struct {
+		callType string
+		count    uint64
+		sum      float64
+		buckets  map[float64]uint64
+	}{
+		{"incoming", 2, 3780, map[float64]uint64{60: 1, 3600: 1, 7200: 2}},
+		{"outgoing", 2, 2100, map[float64]uint64{60: 0, 300: 1, 1800: 2, 7200: 2}},
+	}
+	for _, tt := range durations {
+		d := cc.durations[tt.callType]
+		if d == nil {
+			t.Errorf("%s: no durations", tt.callType)
+			continue
+		}
+		if d.count != tt.count || d.sum != tt.sum {
+			t.Errorf("%s: got count %d sum %v, want count %d sum %v", tt.callType, d.count, d.sum, tt.count, tt.sum)
+		}
+		for b, want := range tt.buckets {
+			if d.buckets[b] != want {
+				t.Errorf("%s: bucket %v got %d, want %d", tt.callType, b, d.buckets[b], want)
+			}
+		}
+	}
+	if len(cc.durations) != len(durations) {
+		t.Errorf("got durations of %d types, want %d", len(cc.durations), len(durations))
+	}
+}
+
+func TestCallCollectorCountSinceLastScrape(t *testing.T) {
+	finished := func(list *callList) *callList {
+		// the active call finished and a new call was missed
+		list.Calls[0].Type = callTypeIncoming
+		list.Calls[0].Duration = "0:10"
+		list.Calls = append(list.Calls, &callEntry{ID: 8, Type: callTypeMissed, Port: "1", CalledNumber: "12345"})
+		return list
+	}
+
+	tests := []struct {
+		name     string
+		lists    []*callList
+		incoming uint64 // incoming calls on port 1 to 12345
+		missed   uint64 // missed calls on port 1 to 12345
+		lastID   int
+	}{
+		{
+			name:     "same list twice",
+			lists:    []*callList{loadCallList(t), loadCallList(t)},
+			incoming: 1,
+			missed:   1,
+			lastID:   6,
+		},
+		{
+			name:     "active call finished",
+			lists:    []*callList{loadCallList(t), finished(loadCallList(t))},
+			incoming: 2,
+			missed:   2,
+			lastID:   8,
+		},
+		{
+			name:     "old calls removed",
+			lists:    []*callList{loadCallList(t), {Calls: []*callEntry{{ID: 8, Type: callTypeMissed, Port: "1", CalledNumber: "12345"}}}},
+			incoming: 1,
+			missed:   2,
+			lastID:   8,
+		},
+		{
+			name: "active call before finished calls",
+			lists: []*callList{{Calls: []*callEntry{
+				{ID: 3, Type: callTypeMissed, Port: "1", CalledNumber: "12345"},
+				{ID: 2, Type: callTypeActiveIncoming, Port: "1", CalledNumber: "12345"},
+				{ID: 1, Type: callTypeMissed, Port: "1", CalledNumber: "12345"},
+			}}},
+			missed: 1,
+			lastID: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		cc := newCallCollector().(*callCollector)
+		for _, list := range tt.lists {
+			cc.count(list)
+		}
+
+		if got := cc.calls[callKey{"incoming", "1", "12345"}]; got != tt.incoming {
+			t.Errorf("%s: got %d incoming calls, want %d", tt.name, got, tt.incoming)
+		}
+		if got := cc.calls[callKey{"missed", "1", "12345"}]; got != tt.missed {
+			t.Errorf("%s: got %d missed calls, want %d", tt.name, got, tt.missed)
+		}
+		if cc.lastID != tt.lastID {
+			t.Errorf("%s: got last ID %d, want %d", tt.name, cc.lastID, tt.lastID)
+		}
+	}
+}
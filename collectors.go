@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	lua "github.com/sberk42/fritzbox_exporter/fritzbox_lua"
+	upnp "github.com/sberk42/fritzbox_exporter/fritzbox_upnp"
+	"github.com/sirupsen/logrus"
+)
+
+// subCollector collects metrics of an API that can't be described by metric definitions.
+// It is enabled by its name in the collectors of the target and keeps its state for the lifetime of the collector.
+type subCollector interface {
+	collect(fc *FritzboxCollector, sc *scrape, ch chan<- prometheus.Metric)
+}
+
+// subCollectorDef creates a sub collector and tells which APIs it uses
+type subCollectorDef struct {
+	create   func() subCollector
+	services bool // needs the upnp services
+	lua      bool // needs a lua session
+}
+
+// subCollectorDefs sub collectors by name
+var subCollectorDefs = map[string]*subCollectorDef{
+	collectorCalls:          {create: newCallCollector, services: true},
+	collectorHomeauto:       {create: newHomeautoCollector, services: true},
+	collectorHomeautoSwitch: {create: newHomeautoSwitchCollector, lua: true},
+	collectorDSL:            {create: newDSLCollector, services: true, lua: true},
+	collectorWLAN:           {create: newWLANCollector, services: true},
+	collectorMesh:           {create: newMeshCollector, services: true},
+	collectorInetstat:       {create: newInetstatCollector, lua: true},
+	collectorInventory:      {create: newInventoryCollector, services: true},
+}
+
+// getDocument gets the document whose URL is returned as result urlResult by the action, URLs without host are relative
+// to the base URL of the services. Both the action result and the document are cached for ttl seconds.
+func (fc *FritzboxCollector) getDocument(sc *scrape, serviceType string, actionName string, urlResult string, ttl int64, actionArgs ...*upnp.ActionArgument) ([]byte, error) {
+	result, err := fc.getActionResult(sc, serviceType, actionName, ttl, actionArgs...)
+	if err != nil {
+		return nil, err
+	}
+
+	docURL, ok := result[urlResult].(string)
+	if !ok || docURL == "" {
+		err = fmt.Errorf("%s.%s has no result %s", serviceType, actionName, urlResult)
+		sc.stats.record(serviceType, actionName, 0, err, causeMissingResult)
+		return nil, err
+	}
+
+	docURL, err = fc.resolveURL(docURL)
+	if err != nil {
+		sc.stats.record(serviceType, actionName, 0, err, causeParse)
+		return nil, err
+	}
+
+	key := serviceType + "|" + actionName + "|document"
+	for _, actionArg := range actionArgs {
+		key += "|" + actionArg.Name + "|" + formatValue(actionArg.Value)
+	}
+
+	var duration time.Duration // stays 0 if cached
+	doc, err := fc.upnpCache.get(key, ttl, func() (interface{}, error) {
+		sc.workers <- struct{}{}
+		defer func() { <-sc.workers }()
+
+		start := time.Now()
+		defer func() { duration = time.Since(start) }()
+
+		return fc.fetchURL(actionName, docURL)
+	})
+
+	sc.stats.record(serviceType, actionName, duration, err, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return doc.([]byte), nil
+}
+
+// resolveURL resolves URLs without host against the base URL of the services
+func (fc *FritzboxCollector) resolveURL(rawURL string) (string, error) {
+	ref, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid document URL %s: %w", rawURL, err)
+	}
+	if ref.IsAbs() {
+		return rawURL, nil
+	}
+
+	fc.Lock()
+	baseURL := fc.Root.BaseURL
+	fc.Unlock()
+
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid base URL %s: %w", baseURL, err)
+	}
+
+	return base.ResolveReference(ref).String(), nil
+}
+
+// fetchURL loads the document from the FRITZ!Box, the URL already contains the session
+func (fc *FritzboxCollector) fetchURL(actionName string, docURL string) ([]byte, error) {
+	client := fc.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Get(docURL)
+	if err != nil {
+		return nil, fmt.Errorf("%s: error loading document: %w", actionName, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &upnp.HTTPStatusError{Action: actionName, StatusCode: resp.StatusCode}
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// logCollectError logs and counts errors of sub collectors, errors of skipped actions are ignored
+func logCollectError(what string, err error) {
+	if err == nil || errors.Is(err, errActionSkipped) {
+		return
+	}
+
+	logrus.Warnf("can not collect %s: %s", what, err)
+	collectErrors.Inc()
+}
+
+// argumentResults returns the results of the action by name of the output argument without the prefix New, so
+// results can be used without knowing the state variables
+func (fc *FritzboxCollector) argumentResults(serviceType string, actionName string, result upnp.Result) map[string]interface{} {
+	fc.Lock()
+	root := fc.Root
+	fc.Unlock()
+
+	res := make(map[string]interface{})
+	s, ok := root.Services[serviceType]
+	if !ok {
+		return res
+	}
+	a, ok := s.Actions[actionName]
+	if !ok {
+		return res
+	}
+
+	for _, arg := range a.Arguments {
+		if arg.Direction != "out" || arg.StateVariable == nil {
+			continue
+		}
+		if val, ok := result[arg.StateVariable.Name]; ok {
+			res[strings.TrimPrefix(arg.Name, "New")] = val
+		}
+	}
+
+	return res
+}
+
+// forwardUnique sends the metrics to ch until metrics is closed, metrics with the same name and labels as a metric sent
+// before are dropped and counted as errors
+func forwardUnique(ch chan<- prometheus.Metric, metrics <-chan prometheus.Metric) {
+	sent := make(map[string]bool)
+	for m := range metrics {
+		key, err := metricKey(m)
+		if err != nil {
+			// invalid metrics are reported by the registry
+			ch <- m
+			continue
+		}
+
+		if sent[key] {
+			logrus.Warnf("metric reported before: %s", key)
+			collectErrors.Inc()
+			continue
+		}
+		sent[key] = true
+
+		ch <- m
+	}
+}
+
+// metricKey identifies the series of the metric by its description and label values
+func metricKey(m prometheus.Metric) (string, error) {
+	var pb dto.Metric
+	err := m.Write(&pb)
+	if err != nil {
+		return "", err
+	}
+
+	var key strings.Builder
+	key.WriteString(m.Desc().String())
+	for _, l := range pb.Label {
+		key.WriteString(" " + l.GetName() + "=" + strconv.Quote(l.GetValue()))
+	}
+	return key.String(), nil
+}
+
+// luaParserJSON name of lua.ParseJSON as parser of lua pages
+const luaParserJSON = "json"
+
+// getLuaJSON gets the parsed JSON of the lua page from cache or loads it using one of the workers
+func (fc *FritzboxCollector) getLuaJSON(sc *scrape, page lua.LuaPage, ttl int64) (map[string]interface{}, error) {
+	data, err := fc.loadLuaPage(sc, page, ttl, luaParserJSON, func(pageData []byte) (interface{}, error) {
+		return lua.ParseJSON(pageData)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	m, ok := data.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected type %T of %s in cache", data, page.Path)
+	}
+	return m, nil
+}
+
+// luaPageCacheKey key of the lua page in cache, the parser is part of the key as pages are cached as parsed.
+// Pages parsed by lua.ParseJSON share the key with the lua metrics.
+func luaPageCacheKey(page lua.LuaPage, parser string) string {
+	key := page.Path + "_" + page.Params
+	if parser != luaParserJSON {
+		key += "_" + parser
+	}
+	return key
+}
+
+// loadLuaPage gets the lua page parsed by parse from cache or loads it using one of the workers,
+// parser names the parse function and must be unique for each function used for the same page
+func (fc *FritzboxCollector) loadLuaPage(sc *scrape, page lua.LuaPage, ttl int64, parser string, parse func([]byte) (interface{}, error)) (interface{}, error) {
+	name := page.Path
+	if page.Params != "" {
+		name += "?" + page.Params
+	}
+
+	var duration time.Duration // stays 0 if cached
+	data, err := fc.luaCache.get(luaPageCacheKey(page, parser), ttl, func() (interface{}, error) {
+		sc.workers <- struct{}{}
+		start := time.Now()
+		pageData, err := fc.LuaSession.LoadData(page)
+		duration = time.Since(start)
+		<-sc.workers
+
+		if err != nil {
+			fc.LuaSession.ClearSID() // clear SID in case of error, so force reauthentication
+			return nil, fmt.Errorf("error loading %s: %w", name, err)
+		}
+
+		data, err := parse(pageData)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s: %w", name, err)
+		}
+
+		return data, nil
+	})
+
+	sc.stats.record(luaService, name, duration, err, "")
+	return data, err
+}
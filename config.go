@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	lua "github.com/sberk42/fritzbox_exporter/fritzbox_lua"
+	"github.com/sirupsen/logrus"
+)
+
+// names of the collectors that can be enabled for a target
+const (
+	collectorUpnp           = "upnp"
+	collectorLua            = "lua"
+	collectorCalls          = "calls"
+	collectorHomeauto       = "homeauto"
+	collectorHomeautoSwitch = "homeautoswitch"
+	collectorDSL            = "dsl"
+	collectorWLAN           = "wlan"
+	collectorMesh           = "mesh"
+	collectorInetstat       = "inetstat"
+	collectorInventory      = "inventory"
+)
+
+var knownCollectors = []string{collectorUpnp, collectorLua, collectorCalls, collectorHomeauto, collectorHomeautoSwitch, collectorDSL, collectorWLAN, collectorMesh, collectorInetstat, collectorInventory}
+
+// Secret value given inline, by environment variable or by file.
+// In JSON a plain string is taken as inline value.
+type Secret struct {
+	Value string `json:"value"`
+	Env   string `json:"env"`
+	File  string `json:"file"`
+}
+
+// UnmarshalJSON accepts a string or an object
+func (s *Secret) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &s.Value)
+	}
+
+	type plainSecret Secret // avoid recursion
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode((*plainSecret)(s))
+}
+
+// resolve returns the value of the secret
+func (s *Secret) resolve() (string, error) {
+	if s == nil {
+		return "", nil
+	}
+
+	set := 0
+	for _, v := range []string{s.Value, s.Env, s.File} {
+		if v != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return "", errors.New("only one of value, env and file may be given")
+	}
+
+	if s.Env != "" {
+		val, ok := os.LookupEnv(s.Env)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", s.Env)
+		}
+		return val, nil
+	}
+
+	if s.File != "" {
+		data, err := ioutil.ReadFile(s.File)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	return s.Value, nil
+}
+
+// TargetConfig settings for a single FRITZ!Box
+type TargetConfig struct {
+	Name           string   `json:"name"`
+	GatewayURL     string   `json:"gatewayUrl"`
+	GatewayLuaURL  string   `json:"gatewayLuaUrl"`
+	Username       *Secret  `json:"username"`
+	Password       *Secret  `json:"password"`
+	VerifyTLS      bool     `json:"verifyTls"`
+	CAFile         string   `json:"caFile"`
+	Collectors     []string `json:"collectors"`
+	MetricsFile    string   `json:"metricsFile"`
+	LuaMetricsFile string   `json:"luaMetricsFile"`
+	CollectWorkers int      `json:"collectWorkers"`
+	Poll           bool     `json:"poll"`
+
+	HostInventoryFile      string `json:"hostInventoryFile"`
+	HostInventoryRetention string `json:"hostInventoryRetention"`
+	ServicesCacheDir       string `json:"servicesCacheDir"`
+
+	// initialized by prepare
+	username string
+	password string
+	client   *http.Client
+	defs     *metricDefinitions
+
+	hostInventoryRetention time.Duration
+}
+
+// ConfigFile JSON struct for the config file
+type ConfigFile struct {
+	Targets []*TargetConfig `json:"targets"`
+}
+
+// configError collects all problems found in the config
+type configError struct {
+	file     string
+	problems []string
+}
+
+func (ce *configError) add(field string, format string, args ...interface{}) {
+	ce.problems = append(ce.problems, field+": "+fmt.Sprintf(format, args...))
+}
+
+func (ce *configError) Error() string {
+	return fmt.Sprintf("invalid config %s:\n  %s", ce.file, strings.Join(ce.problems, "\n  "))
+}
+
+// needsServices checks if any collector enabled for the target uses the upnp services
+func (tc *TargetConfig) needsServices() bool {
+	for _, c := range tc.Collectors {
+		if c == collectorUpnp || (subCollectorDefs[c] != nil && subCollectorDefs[c].services) {
+			return true
+		}
+	}
+	return false
+}
+
+// needsLua checks if any collector enabled for the target uses the lua API
+func (tc *TargetConfig) needsLua() bool {
+	for _, c := range tc.Collectors {
+		if c == collectorLua || (subCollectorDefs[c] != nil && subCollectorDefs[c].lua) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasCollector checks if the collector is enabled for the target
+func (tc *TargetConfig) hasCollector(name string) bool {
+	for _, c := range tc.Collectors {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// metricDefinitions metric definitions loaded from the metric files of a target
+type metricDefinitions struct {
+	metrics      []*Metric
+	luaMetrics   []*LuaMetric
+	labelRenames *[]lua.LabelRename
+}
+
+// metricFileCache definitions already loaded, so targets using the same files share them
+type metricFileCache map[string]*metricDefinitions
+
+func checkURL(ce *configError, field string, rawURL string) {
+	if rawURL == "" {
+		ce.add(field, "is required")
+		return
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		ce.add(field, "invalid URL: %s", err.Error())
+		return
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		ce.add(field, "scheme must be http or https, got '%s'", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		ce.add(field, "host is missing")
+	}
+}
+
+// timeout of each request to the FRITZ!Box, so a box not answering doesn't block loading the services or collecting
+const httpClientTimeout = 30 * time.Second
+
+// newHTTPClient creates the client used for all requests to the target
+func newHTTPClient(verifyTLS bool, caFile string) (*http.Client, error) {
+	if verifyTLS && caFile == "" {
+		return &http.Client{Timeout: httpClientTimeout}, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: !verifyTLS}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{Transport: transport, Timeout: httpClientTimeout}, nil
+}
+
+// prepare validates the target and resolves the credentials.
+// All problems are added to ce with field names prefixed by prefix.
+func (tc *TargetConfig) prepare(ce *configError, prefix string) {
+	if tc.Name == "" {
+		ce.add(prefix+".name", "is required")
+	}
+
+	if len(tc.Collectors) == 0 {
+		tc.Collectors = []string{collectorUpnp, collectorLua, collectorWLAN}
+	}
+
+COLLECTORS:
+	for i, c := range tc.Collectors {
+		for _, kc := range knownCollectors {
+			if c == kc {
+				continue COLLECTORS
+			}
+		}
+		ce.add(fmt.Sprintf("%s.collectors[%d]", prefix, i), "unknown collector '%s', supported: %s", c, strings.Join(knownCollectors, ", "))
+	}
+
+	// the WLAN metrics were moved from the metric files to the collector wlan
+	if tc.hasCollector(collectorUpnp) && !tc.hasCollector(collectorWLAN) {
+		logrus.Warnf("%s.collectors: collector wlan is not enabled, add it to collect the WLAN metrics", prefix)
+	}
+
+	if tc.needsServices() {
+		checkURL(ce, prefix+".gatewayUrl", tc.GatewayURL)
+	}
+	if tc.needsLua() {
+		checkURL(ce, prefix+".gatewayLuaUrl", tc.GatewayLuaURL)
+	}
+
+	var err error
+	tc.username, err = tc.Username.resolve()
+	if err != nil {
+		ce.add(prefix+".username", "%s", err.Error())
+	}
+	tc.password, err = tc.Password.resolve()
+	if err != nil {
+		ce.add(prefix+".password", "%s", err.Error())
+	}
+
+	tc.client, err = newHTTPClient(tc.VerifyTLS, tc.CAFile)
+	if err != nil {
+		ce.add(prefix+".caFile", "%s", err.Error())
+	}
+
+	if tc.CollectWorkers < 0 {
+		ce.add(prefix+".collectWorkers", "must not be negative")
+	} else if tc.CollectWorkers == 0 {
+		tc.CollectWorkers = *flagCollectWorkers
+	}
+
+	if *flagPoll {
+		tc.Poll = true
+	}
+
+	if tc.MetricsFile == "" {
+		tc.MetricsFile = *flagMetricsFile
+	}
+	if tc.LuaMetricsFile == "" {
+		tc.LuaMetricsFile = *flagLuaMetricsFile
+	}
+	if tc.HostInventoryFile == "" {
+		tc.HostInventoryFile = *flagHostInventoryFile
+	}
+	if tc.HostInventoryRetention == "" {
+		tc.hostInventoryRetention = *flagHostInventoryRetention
+	} else {
+		tc.hostInventoryRetention, err = time.ParseDuration(tc.HostInventoryRetention)
+		if err != nil {
+			ce.add(prefix+".hostInventoryRetention", "%s", err.Error())
+		}
+	}
+	if tc.hostInventoryRetention < 0 {
+		ce.add(prefix+".hostInventoryRetention", "must not be negative")
+	}
+	if tc.ServicesCacheDir == "" {
+		tc.ServicesCacheDir = *flagServicesCacheDir
+	}
+}
+
+// fieldPrefix prefix for problems found in the metric files of the target
+func (tc *TargetConfig) fieldPrefix() string {
+	return "targets(" + tc.Name + ")"
+}
+
+// loadDefinitions loads the metric files of the enabled collectors.
+// Problems are added to ce, the returned definitions must not be used in that case.
+func (tc *TargetConfig) loadDefinitions(ce *configError, prefix string, cache metricFileCache) *metricDefinitions {
+	var upnpFile, luaFile string
+	if tc.hasCollector(collectorUpnp) {
+		upnpFile = tc.MetricsFile
+	}
+	if tc.hasCollector(collectorLua) {
+		luaFile = tc.LuaMetricsFile
+	}
+
+	key := upnpFile + "|" + luaFile
+	if defs, ok := cache[key]; ok {
+		return defs
+	}
+
+	defs := &metricDefinitions{}
+	ok := true
+	var err error
+
+	if upnpFile != "" {
+		defs.metrics, err = loadMetrics(upnpFile)
+		if err != nil {
+			ce.add(prefix+".metricsFile", "%s", err.Error())
+			ok = false
+		}
+	}
+
+	if luaFile != "" {
+		defs.luaMetrics, defs.labelRenames, err = loadLuaMetrics(luaFile)
+		if err != nil {
+			ce.add(prefix+".luaMetricsFile", "%s", err.Error())
+			ok = false
+		}
+	}
+
+	if ok {
+		cache[key] = defs
+	}
+
+	return defs
+}
+
+// gatewayName returns the hostname used as gateway label
+func (tc *TargetConfig) gatewayName() string {
+	rawURL := tc.GatewayURL
+	if rawURL == "" {
+		rawURL = tc.GatewayLuaURL
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return tc.Name
+	}
+
+	return u.Hostname()
+}
+
+// flagTarget creates the target configured by command line flags
+func flagTarget() (*TargetConfig, error) {
+	u, err := url.Parse(*flagGatewayURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %s", err.Error())
+	}
+
+	tc := &TargetConfig{
+		Name:           u.Hostname(),
+		GatewayURL:     *flagGatewayURL,
+		GatewayLuaURL:  *flagGatewayLuaURL,
+		Username:       &Secret{Value: *flagUsername},
+		Password:       &Secret{Value: *flagPassword},
+		VerifyTLS:      *flagGatewayVerifyTLS,
+		Collectors:     []string{collectorUpnp, collectorWLAN},
+		MetricsFile:    *flagMetricsFile,
+		LuaMetricsFile: *flagLuaMetricsFile,
+	}
+
+	if !*flagDisableLua {
+		tc.Collectors = append(tc.Collectors, collectorLua)
+	}
+
+	tc.Collectors = append(tc.Collectors, splitList(*flagCollectors)...)
+
+	ce := &configError{file: "from command line"}
+	tc.prepare(ce, "flags")
+	if len(ce.problems) > 0 {
+		return nil, ce
+	}
+
+	return tc, nil
+}
+
+// loadConfig reads and validates the config file, all problems found are reported together
+func loadConfig(file string) ([]*TargetConfig, error) {
+	jsonData, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %s", err.Error())
+	}
+
+	var cf ConfigFile
+	dec := json.NewDecoder(bytes.NewReader(jsonData))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&cf)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %s", file, err.Error())
+	}
+
+	ce := &configError{file: file}
+	if len(cf.Targets) == 0 {
+		ce.add("targets", "at least one target is required")
+	}
+
+	names := make(map[string]bool)
+	for i, tc := range cf.Targets {
+		prefix := fmt.Sprintf("targets[%d]", i)
+		if tc.Name != "" {
+			prefix += "(" + tc.Name + ")"
+		}
+
+		if names[tc.Name] {
+			ce.add(prefix+".name", "duplicate target name")
+		}
+		names[tc.Name] = true
+
+		tc.prepare(ce, prefix)
+	}
+
+	if len(ce.problems) > 0 {
+		return nil, ce
+	}
+
+	return cf.Targets, nil
+}
+
+// loadTargetDefinitions loads the metric definitions of all targets
+func loadTargetDefinitions(targets []*TargetConfig) error {
+	ce := &configError{file: "metric files"}
+	cache := make(metricFileCache)
+
+	for _, tc := range targets {
+		tc.defs = tc.loadDefinitions(ce, tc.fieldPrefix(), cache)
+	}
+
+	if len(ce.problems) > 0 {
+		return ce
+	}
+
+	return nil
+}
+
+// logConfigError logs the error, all problems of a configError are logged separately
+func logConfigError(err error) {
+	ce, ok := err.(*configError)
+	if !ok {
+		logrus.Errorf("%s", err)
+		return
+	}
+
+	logrus.Errorf("invalid config %s", ce.file)
+	for _, p := range ce.problems {
+		logrus.Errorf("  %s", p)
+	}
+}
+
+// splitList splits the comma separated list of a flag, spaces around the entries and empty entries are removed
+func splitList(list string) []string {
+	var entries []string
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	lua "github.com/sberk42/fritzbox_exporter/fritzbox_lua"
+	upnp "github.com/sberk42/fritzbox_exporter/fritzbox_upnp"
+)
+
+const (
+	dslService = "urn:dslforum-org:service:WANDSLInterfaceConfig:1"
+
+	// TTL of the DSL values, the spectrum is only updated by the FRITZ!Box every few seconds
+	dslTTL = 60
+
+	// coded SNR of subcarrier groups without measurement (ITU-T G.997.1)
+	snrNoMeasurement = 255
+)
+
+// states of the DSL interface
+var dslStates = []string{"Up", "Initializing", "EstablishingLink", "NoSignal", "Error", "Disabled"}
+
+var (
+	dslStatPage     = lua.LuaPage{Path: "data.lua", Params: "page=dslStat"}
+	dslSpectrumPage = lua.LuaPage{Path: "GET:internet/dsl_spectrum.lua", Params: "useajax=1&xhr=1"}
+)
+
+// key of the vectoring mode in the JSON of the DSL statistics page
+const vectoringKey = "vectoring"
+
+var (
+	dslStatusDesc = prometheus.NewDesc(
+		"gateway_dsl_status",
+		"Status of the DSL interface, one series per state.",
+		[]string{"gateway", stateLabel},
+		nil,
+	)
+	dslNoiseMarginDesc = prometheus.NewDesc(
+		"gateway_dsl_noise_margin_db",
+		"Noise margin (SNR margin) of the DSL line.",
+		[]string{"gateway", "direction"},
+		nil,
+	)
+	dslAttenuationDesc = prometheus.NewDesc(
+		"gateway_dsl_attenuation_db",
+		"Attenuation of the DSL line.",
+		[]string{"gateway", "direction"},
+		nil,
+	)
+	dslPowerDesc = prometheus.NewDesc(
+		"gateway_dsl_power_dbm",
+		"Transmit power of the DSL line.",
+		[]string{"gateway", "direction"},
+		nil,
+	)
+	dslErrorsDesc = prometheus.NewDesc(
+		"gateway_dsl_errors_total",
+		"Errors of the DSL line by type (crc, fec, hec), errors of the far end are detected by the DSLAM.",
+		[]string{"gateway", "type", "end"},
+		nil,
+	)
+	dslErroredSecondsDesc = prometheus.NewDesc(
+		"gateway_dsl_errored_seconds_total",
+		"Seconds with at least one error (ES).",
+		[]string{"gateway"},
+		nil,
+	)
+	dslSeverelyErroredSecondsDesc = prometheus.NewDesc(
+		"gateway_dsl_severely_errored_seconds_total",
+		"Seconds with many errors (SES).",
+		[]string{"gateway"},
+		nil,
+	)
+	dslRetrainsDesc = prometheus.NewDesc(
+		"gateway_dsl_link_retrains_total",
+		"Number of resyncs of the DSL line.",
+		[]string{"gateway"},
+		nil,
+	)
+	dslInitErrorsDesc = prometheus.NewDesc(
+		"gateway_dsl_init_errors_total",
+		"Number of failed initializations of the DSL line.",
+		[]string{"gateway"},
+		nil,
+	)
+	dslLineInfoDesc = prometheus.NewDesc(
+		"gateway_dsl_line_info",
+		"Profile, modulation and data path of the DSL line, value is always 1.",
+		[]string{"gateway", "profile", "modulation", "data_path"},
+		nil,
+	)
+	dslVectoringInfoDesc = prometheus.NewDesc(
+		"gateway_dsl_vectoring_info",
+		"Vectoring mode of the DSL line as shown in the UI, value is always 1.",
+		[]string{"gateway", "mode"},
+		nil,
+	)
+	dslBandAttenuationDesc = prometheus.NewDesc(
+		"gateway_dsl_band_attenuation_db",
+		"Attenuation of the DSL line by band.",
+		[]string{"gateway", "direction", "band"},
+		nil,
+	)
+	dslToneSNRDesc = prometheus.NewDesc(
+		"gateway_dsl_tone_snr_db",
+		"SNR of the DSL line by subcarrier group, tone is the first tone of the group.",
+		[]string{"gateway", "direction", "tone"},
+		nil,
+	)
+	dslToneBitsDesc = prometheus.NewDesc(
+		"gateway_dsl_tone_bits",
+		"Bits loaded on the subcarriers as shown in the spectrum of the UI, tone is the first tone of the group.",
+		[]string{"gateway", "tone"},
+		nil,
+	)
+)
+
+// dslCollector reports diagnostics of the DSL line from TR-064 and the per tone values of the spectrum in the UI
+type dslCollector struct{}
+
+func newDSLCollector() subCollector {
+	return &dslCollector{}
+}
+
+func (dc *dslCollector) collect(fc *FritzboxCollector, sc *scrape, ch chan<- prometheus.Metric) {
+	dataPath := dc.collectInfo(fc, sc, ch)
+	dc.collectStatistics(fc, sc, ch)
+	dc.collectDSLInfo(fc, sc, ch, dataPath)
+
+	if fc.LuaSession != nil {
+		dc.collectVectoring(fc, sc, ch)
+		dc.collectSpectrum(fc, sc, ch)
+	}
+}
+
+// collectInfo reports status, noise margin, attenuation and power of the line (values are in 0.1 dB(m)) and returns
+// the data path
+func (dc *dslCollector) collectInfo(fc *FritzboxCollector, sc *scrape, ch chan<- prometheus.Metric) string {
+	result, err := fc.getActionResult(sc, dslService, "GetInfo", dslTTL)
+	if err != nil {
+		logCollectError("DSL info", err)
+		return ""
+	}
+
+	if index, err := stateIndex(dslStates, result["Status"]); err == nil {
+		metrics, _ := newConstMetrics(dslStatusDesc, prometheus.GaugeValue, index, dslStates, []string{fc.Gateway})
+		for _, m := range metrics {
+			ch <- m
+		}
+	} else {
+		logCollectError("DSL status", err)
+	}
+
+	for _, direction := range []string{"Upstream", "Downstream"} {
+		labels := []string{fc.Gateway, strings.ToLower(strings.TrimSuffix(direction, "stream"))}
+		dc.report(ch, dslNoiseMarginDesc, prometheus.GaugeValue, result, direction+"NoiseMargin", 0.1, labels...)
+		dc.report(ch, dslAttenuationDesc, prometheus.GaugeValue, result, direction+"Attenuation", 0.1, labels...)
+		dc.report(ch, dslPowerDesc, prometheus.GaugeValue, result, direction+"Power", 0.1, labels...)
+	}
+
+	return formatResult(result["DataPath"])
+}
+
+// collectStatistics reports the error counters since the FRITZ!Box was started
+func (dc *dslCollector) collectStatistics(fc *FritzboxCollector, sc *scrape, ch chan<- prometheus.Metric) {
+	result, err := fc.getActionResult(sc, dslService, "GetStatisticsTotal", dslTTL)
+	if err != nil {
+		logCollectError("DSL statistics", err)
+		return
+	}
+
+	for _, errorType := range []string{"CRC", "FEC", "HEC"} {
+		dc.report(ch, dslErrorsDesc, prometheus.CounterValue, result, "Stats.Total."+errorType+"Errors", 1, fc.Gateway, strings.ToLower(errorType), "near")
+		dc.report(ch, dslErrorsDesc, prometheus.CounterValue, result, "Stats.Total.ATUC"+errorType+"Errors", 1, fc.Gateway, strings.ToLower(errorType), "far")
+	}
+
+	dc.report(ch, dslErroredSecondsDesc, prometheus.CounterValue, result, "Stats.Total.ErroredSecs", 1, fc.Gateway)
+	dc.report(ch, dslSeverelyErroredSecondsDesc, prometheus.CounterValue, result, "Stats.Total.SeverelyErroredSecs", 1, fc.Gateway)
+	dc.report(ch, dslRetrainsDesc, prometheus.CounterValue, result, "Stats.Total.LinkRetrain", 1, fc.Gateway)
+	dc.report(ch, dslInitErrorsDesc, prometheus.CounterValue, result, "Stats.Total.InitErrors", 1, fc.Gateway)
+}
+
+// collectDSLInfo reports the line profile, attenuation per band and SNR per subcarrier group
+func (dc *dslCollector) collectDSLInfo(fc *FritzboxCollector, sc *scrape, ch chan<- prometheus.Metric, dataPath string) {
+	result, err := fc.getActionResult(sc, dslService, "X_AVM-DE_GetDSLInfo", dslTTL)
+	if err != nil {
+		logCollectError("DSL line info", err)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(dslLineInfoDesc, prometheus.GaugeValue, 1, fc.Gateway,
+		sanitizeLabelValue(formatResult(result["CurrentProfile"])),
+		sanitizeLabelValue(formatResult(result["ModulationType"])),
+		sanitizeLabelValue(dataPath))
+
+	for _, direction := range [][2]string{{"us", "up"}, {"ds", "down"}} {
+		suffix, label := direction[0], direction[1]
+
+		// attenuation per band in 0.1 dB
+		for band, latn := range parseNumberList(result["LATN"+suffix]) {
+			if !math.IsNaN(latn) {
+				ch <- prometheus.MustNewConstMetric(dslBandAttenuationDesc, prometheus.GaugeValue, latn/10, fc.Gateway, label, strconv.Itoa(band))
+			}
+		}
+
+		// SNR coded as in G.997.1 for groups of SNRG subcarriers
+		groupSize, err := resultValue(result["SNRG"+suffix], "")
+		if err != nil || groupSize < 1 {
+			groupSize = 1
+		}
+		for group, snr := range parseNumberList(result["SNRps"+suffix]) {
+			if math.IsNaN(snr) || snr == snrNoMeasurement {
+				continue
+			}
+			tone := strconv.Itoa(group * int(groupSize))
+			ch <- prometheus.MustNewConstMetric(dslToneSNRDesc, prometheus.GaugeValue, snr/2-32, fc.Gateway, label, tone)
+		}
+	}
+}
+
+// collectVectoring reports the vectoring mode shown on the DSL statistics page of the UI
+func (dc *dslCollector) collectVectoring(fc *FritzboxCollector, sc *scrape, ch chan<- prometheus.Metric) {
+	data, err := fc.getLuaJSON(sc, dslStatPage, dslTTL)
+	if err != nil {
+		logCollectError("DSL vectoring", err)
+		return
+	}
+
+	value, ok := findJSONValue(data, func(key string, value interface{}) bool {
+		_, isMap := value.(map[string]interface{})
+		_, isArray := value.([]interface{})
+		return key == vectoringKey && !isMap && !isArray
+	})
+	if !ok {
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(dslVectoringInfoDesc, prometheus.GaugeValue, 1, fc.Gateway, sanitizeLabelValue(formatResult(value)))
+}
+
+// collectSpectrum reports the bits per tone of the spectrum page, the values are sent for groups of tones
+func (dc *dslCollector) collectSpectrum(fc *FritzboxCollector, sc *scrape, ch chan<- prometheus.Metric) {
+	data, err := fc.getLuaJSON(sc, dslSpectrumPage, dslTTL)
+	if err != nil {
+		logCollectError("DSL spectrum", err)
+		return
+	}
+
+	port, ok := findJSONValue(data, func(key string, value interface{}) bool {
+		m, isMap := value.(map[string]interface{})
+		return isMap && m["ACT_BIT_VALUES"] != nil
+	})
+	if !ok {
+		err = fmt.Errorf("%s has no ACT_BIT_VALUES", dslSpectrumPage.Path)
+		sc.stats.record(luaService, dslSpectrumPage.Path+"?"+dslSpectrumPage.Params, 0, err, causeMissingResult)
+		logCollectError("DSL spectrum", err)
+		return
+	}
+
+	values := port.(map[string]interface{})
+	groupSize, err := resultValue(values["TONES_PER_BAT_VALUE"], "")
+	if err != nil || groupSize < 1 {
+		groupSize = 1
+	}
+
+	for group, bits := range parseNumberList(values["ACT_BIT_VALUES"]) {
+		if !math.IsNaN(bits) {
+			ch <- prometheus.MustNewConstMetric(dslToneBitsDesc, prometheus.GaugeValue, bits, fc.Gateway, strconv.Itoa(group*int(groupSize)))
+		}
+	}
+}
+
+// report reports the result multiplied by factor, missing results are counted as error
+func (dc *dslCollector) report(ch chan<- prometheus.Metric, desc *prometheus.Desc, valueType prometheus.ValueType, result upnp.Result, name string, factor float64, labels ...string) {
+	value, err := resultValue(result[name], "")
+	if err != nil {
+		logCollectError("DSL "+name, err)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(desc, valueType, value*factor, labels...)
+}
+
+// formatResult formats the result, missing results are empty
+func formatResult(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	return formatValue(value)
+}
+
+// parseNumberList parses comma separated numbers or JSON arrays of numbers, invalid values are NaN to keep the
+// position of the other values
+func parseNumberList(value interface{}) []float64 {
+	var items []interface{}
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		items = v
+	default:
+		sval := strings.TrimSpace(formatValue(v))
+		if sval == "" {
+			return nil
+		}
+		for _, item := range strings.Split(sval, ",") {
+			items = append(items, strings.TrimSpace(item))
+		}
+	}
+
+	numbers := make([]float64, len(items))
+	for i, item := range items {
+		number, err := resultValue(item, "")
+		if err != nil {
+			number = math.NaN()
+		}
+		numbers[i] = number
+	}
+
+	return numbers
+}
+
+// findJSONValue searches the parsed JSON depth first for the first value matching, keys of arrays are the indexes.
+// Keys of objects are searched in sorted order, so the same value is found on every call.
+func findJSONValue(data interface{}, match func(key string, value interface{}) bool) (interface{}, bool) {
+	switch v := data.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if match(key, v[key]) {
+				return v[key], true
+			}
+		}
+		for _, key := range keys {
+			if found, ok := findJSONValue(v[key], match); ok {
+				return found, true
+			}
+		}
+	case []interface{}:
+		for i, value := range v {
+			if match(strconv.Itoa(i), value) {
+				return value, true
+			}
+			if found, ok := findJSONValue(value, match); ok {
+				return found, true
+			}
+		}
+	}
+
+	return nil, false
+}
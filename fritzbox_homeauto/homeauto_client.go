@@ -0,0 +1,206 @@
+// Package homeauto_client implements a client for the smart home API (homeautoswitch.lua) of the FRITZ!Box
+package homeauto_client
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	lua "github.com/sberk42/fritzbox_exporter/fritzbox_lua"
+)
+
+// path of the smart home API, called with GET
+const switchPath = "GET:webservices/homeautoswitch.lua"
+
+// special temperatures of thermostats
+const (
+	thermostatOff = 253
+	thermostatOn  = 254
+)
+
+// Client calls the commands of the smart home API using the SID of the lua session
+type Client struct {
+	Session *lua.LuaSession
+}
+
+// DeviceList XML returned by getdevicelistinfos
+type DeviceList struct {
+	Version         string    `xml:"version,attr"`
+	FirmwareVersion string    `xml:"fwversion,attr"`
+	Devices         []*Device `xml:"device"`
+}
+
+// Device smart home device, the sections are nil if the device does not support the function
+type Device struct {
+	AIN             string `xml:"identifier,attr"`
+	ID              string `xml:"id,attr"`
+	FunctionBitMask int    `xml:"functionbitmask,attr"`
+	FirmwareVersion string `xml:"fwversion,attr"`
+	Manufacturer    string `xml:"manufacturer,attr"`
+	ProductName     string `xml:"productname,attr"`
+
+	Present    bool   `xml:"present"`
+	Name       string `xml:"name"`
+	Battery    *int   `xml:"battery"` // percent
+	BatteryLow *bool  `xml:"batterylow"`
+
+	Switch      *Switch      `xml:"switch"`
+	PowerMeter  *PowerMeter  `xml:"powermeter"`
+	Temperature *Temperature `xml:"temperature"`
+	Alert       *Alert       `xml:"alert"`
+	Thermostat  *Thermostat  `xml:"hkr"`
+	Humidity    *Humidity    `xml:"humidity"`
+}
+
+// Switch state of a switchable socket, values are empty if unknown
+type Switch struct {
+	State string `xml:"state"` // 1 on, 0 off
+	Mode  string `xml:"mode"`  // auto or manuell
+	Lock  string `xml:"lock"`
+}
+
+// PowerMeter values of a power meter
+type PowerMeter struct {
+	Voltage int `xml:"voltage"` // mV
+	Power   int `xml:"power"`   // mW
+	Energy  int `xml:"energy"`  // Wh since the device was reset
+}
+
+// Temperature measured temperature
+type Temperature struct {
+	Celsius int `xml:"celsius"` // 0.1 °C including the offset
+	Offset  int `xml:"offset"`  // 0.1 °C
+}
+
+// Alert state of an alarm sensor
+type Alert struct {
+	State      string `xml:"state"` // 0 no alert, otherwise alert (a bit mask for some devices), empty if unknown
+	LastChange int64  `xml:"lastalertchgtimestamp"`
+}
+
+// Thermostat values of a radiator controller, temperatures in 0.5 °C (see ThermostatCelsius)
+type Thermostat struct {
+	Current    int    `xml:"tist"`
+	Target     int    `xml:"tsoll"`
+	Reduced    int    `xml:"absenk"`
+	Comfort    int    `xml:"komfort"`
+	Lock       string `xml:"lock"`
+	ErrorCode  int    `xml:"errorcode"`
+	BatteryLow bool   `xml:"batterylow"`
+	Battery    int    `xml:"battery"` // percent
+	WindowOpen bool   `xml:"windowopenactiv"`
+	Boost      bool   `xml:"boostactive"`
+}
+
+// Humidity measured relative humidity
+type Humidity struct {
+	Relative int `xml:"rel_humidity"` // percent
+}
+
+// DeviceStats XML returned by getbasicdevicestats, each kind may have series with different grids
+type DeviceStats struct {
+	Temperature []*Stats `xml:"temperature>stats"` // 0.1 °C
+	Humidity    []*Stats `xml:"humidity>stats"`    // percent
+	Voltage     []*Stats `xml:"voltage>stats"`     // mV
+	Power       []*Stats `xml:"power>stats"`       // 0.01 W
+	Energy      []*Stats `xml:"energy>stats"`      // Wh per grid interval
+}
+
+// Stats series of values with a fixed distance, the newest value first
+type Stats struct {
+	Count    int    `xml:"count,attr"`
+	Grid     int    `xml:"grid,attr"`     // distance of the values in seconds
+	DataTime int64  `xml:"datatime,attr"` // Unix time of the newest value, not sent by older versions
+	Data     string `xml:",chardata"`     // comma separated values, - if missing
+}
+
+// Sample value of a series at a time
+type Sample struct {
+	Time  time.Time
+	Value float64
+}
+
+// ThermostatCelsius converts a temperature of a thermostat to °C, ok is false for off, on and unknown values
+func ThermostatCelsius(value int) (celsius float64, ok bool) {
+	if value == thermostatOff || value == thermostatOn || value <= 0 {
+		return 0, false
+	}
+	return float64(value) / 2, true
+}
+
+// Samples returns the values of the series with their times in ascending order, missing values are skipped.
+// Times are relative to DataTime or to newest if the FRITZ!Box doesn't send it.
+func (s *Stats) Samples(newest time.Time) []Sample {
+	if s.DataTime > 0 {
+		newest = time.Unix(s.DataTime, 0)
+	}
+
+	values := strings.Split(strings.TrimSpace(s.Data), ",")
+	samples := make([]Sample, 0, len(values))
+	for i := len(values) - 1; i >= 0; i-- {
+		value, err := strconv.ParseFloat(strings.TrimSpace(values[i]), 64)
+		if err != nil {
+			continue
+		}
+
+		t := newest.Add(-time.Duration(i*s.Grid) * time.Second)
+		samples = append(samples, Sample{Time: t, Value: value})
+	}
+
+	return samples
+}
+
+// GetDeviceListInfos loads the smart home devices with their current values
+func (c *Client) GetDeviceListInfos() (*DeviceList, error) {
+	data, err := c.command("getdevicelistinfos", "")
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseDeviceList(data)
+}
+
+// GetBasicDeviceStats loads the stored values of the device
+func (c *Client) GetBasicDeviceStats(ain string) (*DeviceStats, error) {
+	data, err := c.command("getbasicdevicestats", ain)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseDeviceStats(data)
+}
+
+// ParseDeviceList parses the XML returned by getdevicelistinfos
+func ParseDeviceList(data []byte) (*DeviceList, error) {
+	var list DeviceList
+	err := xml.Unmarshal(data, &list)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing device list: %w", err)
+	}
+
+	return &list, nil
+}
+
+// ParseDeviceStats parses the XML returned by getbasicdevicestats
+func ParseDeviceStats(data []byte) (*DeviceStats, error) {
+	var stats DeviceStats
+	err := xml.Unmarshal(data, &stats)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing device stats: %w", err)
+	}
+
+	return &stats, nil
+}
+
+// command calls the command of the API, ain is only sent if set
+func (c *Client) command(cmd string, ain string) ([]byte, error) {
+	params := "switchcmd=" + cmd
+	if ain != "" {
+		params += "&ain=" + url.QueryEscape(ain)
+	}
+
+	return c.Session.LoadData(lua.LuaPage{Path: switchPath, Params: params})
+}
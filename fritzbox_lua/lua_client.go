@@ -27,6 +27,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 
 	"golang.org/x/text/encoding/unicode"
 	"golang.org/x/text/transform"
@@ -45,8 +46,11 @@ type LuaSession struct {
 	BaseURL     string
 	Username    string
 	Password    string
+	Client      *http.Client // optional, http.DefaultClient is used if not set
 	SID         string
 	SessionInfo SessionInfo
+
+	lock sync.Mutex // protects SID and SessionInfo, pages may be loaded concurrently
 }
 
 // LuaPage identified by path and params
@@ -61,6 +65,9 @@ type LuaMetricValueDefinition struct {
 	Key     string
 	OkValue string
 	Labels  []string
+
+	// Convert converts the value if set (instead of OkValue), values it fails for are skipped
+	Convert func(value interface{}) (float64, error)
 }
 
 // LuaMetricValue single value retrieved from lua page
@@ -76,13 +83,21 @@ type LabelRename struct {
 	Name    string
 }
 
+func (lua *LuaSession) httpClient() *http.Client {
+	if lua.Client != nil {
+		return lua.Client
+	}
+
+	return http.DefaultClient
+}
+
 func (lua *LuaSession) doLogin(response string) error {
 	urlParams := ""
 	if response != "" {
 		urlParams = fmt.Sprintf("?response=%s&user=%s", response, lua.Username)
 	}
 
-	resp, err := http.Get(fmt.Sprintf("%s/login_sid.lua%s", lua.BaseURL, urlParams))
+	resp, err := lua.httpClient().Get(fmt.Sprintf("%s/login_sid.lua%s", lua.BaseURL, urlParams))
 	if err != nil {
 		return fmt.Errorf("Error calling login_sid.lua: %s", err.Error())
 	}
@@ -114,7 +129,37 @@ func (lmvDef *LuaMetricValueDefinition) createValue(name string, value float64)
 
 // Login perform loing and get SID
 func (lua *LuaSession) Login() error {
+	lua.lock.Lock()
+	defer lua.lock.Unlock()
+
+	return lua.login()
+}
+
+// ClearSID forces a new login for the next page loaded
+func (lua *LuaSession) ClearSID() {
+	lua.lock.Lock()
+	lua.SID = ""
+	lua.lock.Unlock()
+}
+
+// sessionID returns the current SID, login is performed if there is none or it is still failedSID.
+// So if concurrent calls fail with the same SID the login is only done once.
+func (lua *LuaSession) sessionID(failedSID string) (sid string, loggedIn bool, err error) {
+	lua.lock.Lock()
+	defer lua.lock.Unlock()
+
+	if lua.SID == "" || lua.SID == failedSID {
+		err = lua.login()
+		if err != nil {
+			return "", false, err
+		}
+		loggedIn = true
+	}
+
+	return lua.SID, loggedIn, nil
+}
 
+func (lua *LuaSession) login() error {
 	err := lua.doLogin("")
 	if err != nil {
 		return err
@@ -156,31 +201,26 @@ func (lua *LuaSession) LoadData(page LuaPage) ([]byte, error) {
 
 	dataURL := fmt.Sprintf("%s/%s", lua.BaseURL, path)
 
-	callDone := false
 	var resp *http.Response
-	var err error
-	for !callDone {
+	failedSID := ""
+	for {
 		// perform login if no SID or previous call failed with (403)
-		if lua.SID == "" || resp != nil {
-			err = lua.Login()
-			callDone = true // consider call done, since we tried login
-
-			if err != nil {
-				return nil, err
-			}
+		sid, loggedIn, err := lua.sessionID(failedSID)
+		if err != nil {
+			return nil, err
 		}
 
 		// send by UI for data.lua: xhr=1&sid=xxxxxxx&lang=de&page=energy&xhrId=all&no_sidrenew=
 		// but SID and page seem to be enough
-		params := "sid=" + lua.SID
+		params := "sid=" + sid
 		if page.Params != "" {
 			params += "&" + page.Params
 		}
 
 		if method == "POST" {
-			resp, err = http.Post(dataURL, "application/x-www-form-urlencoded", bytes.NewBuffer([]byte(params)))
+			resp, err = lua.httpClient().Post(dataURL, "application/x-www-form-urlencoded", bytes.NewBuffer([]byte(params)))
 		} else if method == "GET" {
-			resp, err = http.Get(dataURL + "?" + params)
+			resp, err = lua.httpClient().Get(dataURL + "?" + params)
 		} else {
 			err = fmt.Errorf("method %s is unsupported in path %s", method, page.Path)
 		}
@@ -188,16 +228,20 @@ func (lua *LuaSession) LoadData(page LuaPage) ([]byte, error) {
 		if err != nil {
 			return nil, err
 		}
-		defer resp.Body.Close()
 
 		if resp.StatusCode == http.StatusOK {
-			callDone = true
-		} else if resp.StatusCode == http.StatusForbidden && !callDone {
-			// we assume SID is expired, so retry login
-		} else {
+			break
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusForbidden || loggedIn || failedSID != "" {
 			return nil, fmt.Errorf("%s failed: %s", page.Path, resp.Status)
 		}
+
+		// we assume SID is expired, so retry login
+		failedSID = sid
 	}
+	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
 
@@ -303,7 +347,12 @@ VALUE:
 
 		var sVal = toString(valUntyped)
 		var floatVal float64
-		if metricDef.OkValue != "" {
+		if metricDef.Convert != nil {
+			floatVal, err = metricDef.Convert(valUntyped)
+			if err != nil {
+				continue VALUE
+			}
+		} else if metricDef.OkValue != "" {
 			if metricDef.OkValue == sVal {
 				floatVal = 1
 			} else {
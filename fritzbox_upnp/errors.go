@@ -0,0 +1,56 @@
+package fritzbox_upnp
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// UPnP error codes returned in SOAP faults
+const (
+	ErrorCodeInvalidAction       = 401
+	ErrorCodeInvalidArgs         = 402
+	ErrorCodeActionFailed        = 501
+	ErrorCodeArgumentInvalid     = 600
+	ErrorCodeActionNotAuthorized = 606
+	ErrorCodeArrayIndexInvalid   = 713
+	ErrorCodeInternalError       = 820
+)
+
+// SoapFaultError SOAP fault returned by an action call
+type SoapFaultError struct {
+	Action      string
+	FaultString string
+	Code        int // UPnP error code, 0 if the fault is no UPnPError
+	Description string
+}
+
+func (e *SoapFaultError) Error() string {
+	if e.Code == 0 {
+		return fmt.Sprintf("%s: SAOPFault: %s", e.Action, e.FaultString)
+	}
+	return fmt.Sprintf("%s: SAOPFault: %s %d (%s)", e.Action, e.FaultString, e.Code, e.Description)
+}
+
+// HTTPStatusError unexpected HTTP status returned by an action call
+type HTTPStatusError struct {
+	Action     string
+	StatusCode int
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("%s: %s (%d)", e.Action, http.StatusText(e.StatusCode), e.StatusCode)
+}
+
+// AuthError authentication for an action call failed
+type AuthError struct {
+	Action string
+	Err    error
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("%s: authentication failed: %s", e.Action, e.Err.Error())
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
@@ -27,6 +27,8 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // curl http://fritz.box:49000/igddesc.xml
@@ -47,6 +49,39 @@ type Root struct {
 	Password string
 	Device   Device              `xml:"device"`
 	Services map[string]*Service // Map of all services indexed by .ServiceType
+
+	SystemVersion *SystemVersion `xml:"systemVersion"` // firmware of the device, nil if not sent in tr64desc.xml
+
+	client     *http.Client // client used for all requests
+	authLock   sync.Mutex   // protects authHeader, actions may be called concurrently
+	authHeader string       // stored auth header for reuse
+
+	// UnknownDataType is called once for each result argument with a data type that is not converted,
+	// the values of these arguments are returned as string
+	UnknownDataType func(s *Service, a *Action, arg *Argument)
+}
+
+func (r *Root) getAuthHeader() string {
+	r.authLock.Lock()
+	defer r.authLock.Unlock()
+
+	return r.authHeader
+}
+
+func (r *Root) setAuthHeader(authHeader string) {
+	r.authLock.Lock()
+	r.authHeader = authHeader
+	r.authLock.Unlock()
+}
+
+// SystemVersion firmware version from tr64desc.xml
+type SystemVersion struct {
+	HW          string `xml:"HW" json:"hw"`
+	Major       string `xml:"Major" json:"major"`
+	Minor       string `xml:"Minor" json:"minor"`
+	Patch       string `xml:"Patch" json:"patch"`
+	Buildnumber string `xml:"Buildnumber" json:"buildnumber"`
+	Display     string `xml:"Display" json:"display"` // e.g. 154.07.29
 }
 
 // Device an UPNP device
@@ -71,7 +106,7 @@ type Device struct {
 
 // Service an UPNP Service
 type Service struct {
-	Device *Device
+	Device *Device `json:"-"`
 
 	ServiceType string `xml:"serviceType"`
 	ServiceID   string `xml:"serviceId"`
@@ -94,7 +129,10 @@ type Action struct {
 
 	Name        string               `xml:"name"`
 	Arguments   []*Argument          `xml:"argumentList>argument"`
-	ArgumentMap map[string]*Argument // Map of arguments indexed by .Name
+	ArgumentMap map[string]*Argument `json:"-"` // Map of arguments indexed by .Name
+
+	unknownLock     sync.Mutex
+	unknownReported map[string]bool // arguments with unknown data type already reported
 }
 
 // ActionArgument an Inüut Argument to pass to an action
@@ -147,10 +185,10 @@ func (a *Action) IsGetOnly() bool {
 
 // An Argument to an action
 type Argument struct {
-	Name                 string `xml:"name"`
-	Direction            string `xml:"direction"`
-	RelatedStateVariable string `xml:"relatedStateVariable"`
-	StateVariable        *StateVariable
+	Name                 string         `xml:"name"`
+	Direction            string         `xml:"direction"`
+	RelatedStateVariable string         `xml:"relatedStateVariable"`
+	StateVariable        *StateVariable `json:"-"`
 }
 
 // StateVariable a state variable that can be manipulated through actions
@@ -162,12 +200,14 @@ type StateVariable struct {
 
 // Result The result of a Call() contains all output arguments of the call.
 // The map is indexed by the name of the state variable.
-// The type of the value is string, uint64 or bool depending of the DataType of the variable.
+// The type of the value depends on the DataType of the variable: uint64 for ui1-ui8, int64 for i1-i8, float64 for
+// r4, r8, number, float and fixed.14.4, bool for boolean, time.Time for dateTime (zero if not set) and string for all
+// others.
 type Result map[string]interface{}
 
 // load the whole tree
 func (r *Root) load() error {
-	igddesc, err := http.Get(
+	igddesc, err := r.client.Get(
 		fmt.Sprintf("%s/igddesc.xml", r.BaseURL),
 	)
 
@@ -189,7 +229,7 @@ func (r *Root) load() error {
 }
 
 func (r *Root) loadTr64() error {
-	igddesc, err := http.Get(
+	igddesc, err := r.client.Get(
 		fmt.Sprintf("%s/tr64desc.xml", r.BaseURL),
 	)
 
@@ -217,7 +257,7 @@ func (d *Device) fillServices(r *Root) error {
 	for _, s := range d.Services {
 		s.Device = d
 
-		response, err := http.Get(r.BaseURL + s.SCPDUrl)
+		response, err := r.client.Get(r.BaseURL + s.SCPDUrl)
 		if err != nil {
 			return err
 		}
@@ -237,21 +277,7 @@ func (d *Device) fillServices(r *Root) error {
 			s.Actions[a.Name] = a
 		}
 		s.StateVariables = scpd.StateVariables
-
-		for _, a := range s.Actions {
-			a.service = s
-			a.ArgumentMap = make(map[string]*Argument)
-
-			for _, arg := range a.Arguments {
-				for _, svar := range s.StateVariables {
-					if arg.RelatedStateVariable == svar.Name {
-						arg.StateVariable = svar
-					}
-				}
-
-				a.ArgumentMap[arg.Name] = arg
-			}
-		}
+		s.linkActions()
 
 		r.Services[s.ServiceType] = s
 	}
@@ -264,6 +290,24 @@ func (d *Device) fillServices(r *Root) error {
 	return nil
 }
 
+// link actions and arguments to the service and its state variables
+func (s *Service) linkActions() {
+	for _, a := range s.Actions {
+		a.service = s
+		a.ArgumentMap = make(map[string]*Argument)
+
+		for _, arg := range a.Arguments {
+			for _, svar := range s.StateVariables {
+				if arg.RelatedStateVariable == svar.Name {
+					arg.StateVariable = svar
+				}
+			}
+
+			a.ArgumentMap[arg.Name] = arg
+		}
+	}
+}
+
 const soapActionXML = `<?xml version="1.0" encoding="utf-8"?>` +
 	`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
 	`<s:Body><u:%s xmlns:u=%s>%s</u:%s xmlns:u=%s></s:Body>` +
@@ -271,11 +315,60 @@ const soapActionXML = `<?xml version="1.0" encoding="utf-8"?>` +
 
 const soapActionParamXML = `<%s>%s</%s>`
 
-func (a *Action) createCallHTTPRequest(actionArg *ActionArgument) (*http.Request, error) {
+// formatArgument formats the value according to the data type of the state variable of the input argument
+func (a *Action) formatArgument(actionArg *ActionArgument) (string, error) {
+	arg, ok := a.ArgumentMap[actionArg.Name]
+	if !ok || arg.Direction != "in" {
+		return "", fmt.Errorf("%s has no input argument %s", a.Name, actionArg.Name)
+	}
+
+	sValue := fmt.Sprintf("%v", actionArg.Value)
+	if t, ok := actionArg.Value.(time.Time); ok {
+		sValue = t.Format(dateTimeLayout)
+	}
+
+	if arg.StateVariable == nil {
+		return sValue, nil
+	}
+
+	var err error
+	switch arg.StateVariable.DataType {
+	case "boolean":
+		var b bool
+		b, err = strconv.ParseBool(sValue)
+		if err == nil {
+			// the value is only replaced if valid, so errors show the value given
+			sValue = "0"
+			if b {
+				sValue = "1"
+			}
+		}
+	case "ui1", "ui2", "ui4", "ui8":
+		_, err = strconv.ParseUint(sValue, 10, 64)
+	case "i1", "i2", "i4", "i8":
+		_, err = strconv.ParseInt(sValue, 10, 64)
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("invalid value '%s' for argument %s of type %s", sValue, actionArg.Name, arg.StateVariable.DataType)
+	}
+
+	return sValue, nil
+}
+
+func (a *Action) createCallHTTPRequest(actionArgs []*ActionArgument) (*http.Request, error) {
 	argsString := ""
-	if actionArg != nil {
+	for _, actionArg := range actionArgs {
+		if actionArg == nil {
+			continue
+		}
+
+		sValue, err := a.formatArgument(actionArg)
+		if err != nil {
+			return nil, err
+		}
+
 		var buf bytes.Buffer
-		sValue := fmt.Sprintf("%v", actionArg.Value)
 		xml.EscapeText(&buf, []byte(sValue))
 		argsString += fmt.Sprintf(soapActionParamXML, actionArg.Name, buf.String(), actionArg.Name)
 	}
@@ -297,24 +390,22 @@ func (a *Action) createCallHTTPRequest(actionArg *ActionArgument) (*http.Request
 	return req, nil
 }
 
-// store auth header for reuse
-var authHeader = ""
-
-// Call an action with argument if given
-func (a *Action) Call(actionArg *ActionArgument) (Result, error) {
-	req, err := a.createCallHTTPRequest(actionArg)
+// Call an action with the arguments given, the values are formatted according to the data type of the arguments
+func (a *Action) Call(actionArgs ...*ActionArgument) (Result, error) {
+	root := a.service.Device.root
+	req, err := a.createCallHTTPRequest(actionArgs)
 
 	if err != nil {
 		return nil, err
 	}
 
 	// reuse prior authHeader, to avoid unnecessary authentication
-	if authHeader != "" {
+	if authHeader := root.getAuthHeader(); authHeader != "" {
 		req.Header.Set("Authorization", authHeader)
 	}
 
 	// first try call without auth header
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := root.client.Do(req)
 
 	if err != nil {
 		return nil, err
@@ -324,63 +415,73 @@ func (a *Action) Call(actionArg *ActionArgument) (Result, error) {
 	if resp.StatusCode == http.StatusUnauthorized {
 		resp.Body.Close() // close now, since we make a new request below or fail
 
-		if wwwAuth != "" && a.service.Device.root.Username != "" && a.service.Device.root.Password != "" {
-			// call failed, but we have a password so calculate header and try again
-			authHeader, err = a.getDigestAuthHeader(wwwAuth, a.service.Device.root.Username, a.service.Device.root.Password)
-			if err != nil {
-				return nil, fmt.Errorf("%s: %s", a.Name, err.Error())
-			}
+		if wwwAuth == "" || root.Username == "" || root.Password == "" {
+			return nil, &AuthError{Action: a.Name, Err: errors.New("unauthorized, but no username and password given")}
+		}
 
-			req, err = a.createCallHTTPRequest(actionArg)
-			if err != nil {
-				return nil, fmt.Errorf("%s: %s", a.Name, err.Error())
-			}
+		// call failed, but we have a password so calculate header and try again
+		authHeader, err := a.getDigestAuthHeader(wwwAuth, root.Username, root.Password)
+		if err != nil {
+			return nil, &AuthError{Action: a.Name, Err: err}
+		}
+		root.setAuthHeader(authHeader)
 
-			req.Header.Set("Authorization", authHeader)
+		req, err = a.createCallHTTPRequest(actionArgs)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", a.Name, err)
+		}
 
-			resp, err = http.DefaultClient.Do(req)
+		req.Header.Set("Authorization", authHeader)
 
-			if err != nil {
-				return nil, fmt.Errorf("%s: %s", a.Name, err.Error())
-			}
+		resp, err = root.client.Do(req)
 
-		} else {
-			return nil, fmt.Errorf("%s: Unauthorized, but no username and password given", a.Name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", a.Name, err)
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized {
+			resp.Body.Close()
+			return nil, &AuthError{Action: a.Name, Err: errors.New("unauthorized, check username and password")}
 		}
 	}
 
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusInternalServerError {
+		return nil, a.parseSoapFault(resp.Body)
+	}
+
 	if resp.StatusCode != http.StatusOK {
-		errMsg := fmt.Sprintf("%s (%d)", http.StatusText(resp.StatusCode), resp.StatusCode)
-		if resp.StatusCode == 500 {
-			buf := new(strings.Builder)
-			io.Copy(buf, resp.Body)
-			body := buf.String()
-			//fmt.Println(body)
-
-			var soapEnv SoapEnvelope
-			err := xml.Unmarshal([]byte(body), &soapEnv)
-			if err != nil {
-				errMsg = fmt.Sprintf("error decoding SOAPFault: %s", err.Error())
-			} else {
-				soapFault := soapEnv.Body.Fault
-
-				if soapFault.FaultString == "UPnPError" {
-					upe := soapFault.Detail.UpnpError
-
-					errMsg = fmt.Sprintf("SAOPFault: %s %d (%s)", soapFault.FaultString, upe.ErrorCode, upe.ErrorDescription)
-				} else {
-					errMsg = fmt.Sprintf("SAOPFault: %s", soapFault.FaultString)
-				}
-			}
-		}
-		return nil, fmt.Errorf("%s: %s", a.Name, errMsg)
+		return nil, &HTTPStatusError{Action: a.Name, StatusCode: resp.StatusCode}
 	}
 
 	return a.parseSoapResponse(resp.Body)
 }
 
+// parseSoapFault returns the SOAP fault contained in the body as error, bodies without SOAP fault (e.g. error pages of
+// a proxy) are returned as HTTP status error
+func (a *Action) parseSoapFault(body io.Reader) error {
+	var soapEnv SoapEnvelope
+	err := xml.NewDecoder(body).Decode(&soapEnv)
+	if err != nil || soapEnv.Body.Fault.XMLName.Local == "" {
+		return &HTTPStatusError{Action: a.Name, StatusCode: http.StatusInternalServerError}
+	}
+
+	soapFault := soapEnv.Body.Fault
+	sfe := &SoapFaultError{Action: a.Name, FaultString: soapFault.FaultString}
+	if soapFault.FaultString == "UPnPError" {
+		sfe.Code = soapFault.Detail.UpnpError.ErrorCode
+		sfe.Description = soapFault.Detail.UpnpError.ErrorDescription
+	}
+
+	return sfe
+}
+
+// ClearAuth drops the stored auth header, so the next call authenticates again
+func (r *Root) ClearAuth() {
+	r.setAuthHeader("")
+}
+
 func (a *Action) getDigestAuthHeader(wwwAuth string, username string, password string) (string, error) {
 	// parse www-auth header
 	if !strings.HasPrefix(wwwAuth, "Digest ") {
@@ -462,7 +563,10 @@ func (a *Action) parseSoapResponse(r io.Reader) (Result, error) {
 				}
 
 				converted, err := convertResult(val, arg)
-				if err != nil {
+				if errors.Is(err, errUnknownDataType) {
+					a.reportUnknownDataType(arg)
+					converted = val
+				} else if err != nil {
 					return nil, err
 				}
 				res[arg.StateVariable.Name] = converted
@@ -472,46 +576,101 @@ func (a *Action) parseSoapResponse(r io.Reader) (Result, error) {
 	}
 }
 
+// errUnknownDataType returned by convertResult for data types it does not convert
+var errUnknownDataType = errors.New("unknown datatype")
+
+// layout of the dateTime data type, FRITZ!Box times have no time zone and are local times
+const dateTimeLayout = "2006-01-02T15:04:05"
+
 func convertResult(val string, arg *Argument) (interface{}, error) {
 	switch arg.StateVariable.DataType {
-	case "string":
+	case "string", "uuid", "char":
 		return val, nil
 	case "boolean":
 		return bool(val == "1"), nil
 
-	case "ui1", "ui2", "ui4":
+	case "ui1", "ui2", "ui4", "ui8":
 		// type ui4 can contain values greater than 2^32!
 		res, err := strconv.ParseUint(val, 10, 64)
 		if err != nil {
 			return nil, err
 		}
 		return uint64(res), nil
-	case "i4":
+	case "i1", "i2", "i4", "i8":
 		res, err := strconv.ParseInt(val, 10, 64)
 		if err != nil {
 			return nil, err
 		}
 		return int64(res), nil
-	case "dateTime", "uuid":
-		// data types we don't convert yet
-		return val, nil
+	case "r4", "r8", "number", "float", "fixed.14.4":
+		return strconv.ParseFloat(val, 64)
+	case "dateTime":
+		return parseDateTime(val)
 	default:
-		return nil, fmt.Errorf("unknown datatype: %s (%s)", arg.StateVariable.DataType, val)
+		return nil, fmt.Errorf("%w: %s (%s)", errUnknownDataType, arg.StateVariable.DataType, val)
+	}
+}
+
+// parseDateTime parses dateTime values with or without time zone, empty values are returned as zero time
+func parseDateTime(val string) (time.Time, error) {
+	if val == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.ParseInLocation(dateTimeLayout, val, time.Local)
+	if err == nil {
+		return t, nil
+	}
+
+	t, err = time.Parse(time.RFC3339, val)
+	if err == nil {
+		return t, nil
+	}
+
+	return time.ParseInLocation("2006-01-02", val, time.Local)
+}
+
+// reportUnknownDataType calls the UnknownDataType handler of the root once for the argument
+func (a *Action) reportUnknownDataType(arg *Argument) {
+	a.unknownLock.Lock()
+	defer a.unknownLock.Unlock()
+
+	if a.unknownReported[arg.Name] {
+		return
+	}
+
+	if a.unknownReported == nil {
+		a.unknownReported = make(map[string]bool)
+	}
+	a.unknownReported[arg.Name] = true
+
+	if handler := a.service.Device.root.UnknownDataType; handler != nil {
+		handler(a.service, a, arg)
 	}
 }
 
 // LoadServices loads the services tree from an device.
 func LoadServices(baseurl string, username string, password string, verifyTls bool) (*Root, error) {
+	client := http.DefaultClient
 
 	if !verifyTls && strings.HasPrefix(baseurl, "https://") {
 		// disable certificate validation, since fritz.box uses self signed cert
-		http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		client = &http.Client{Transport: transport}
 	}
 
+	return LoadServicesWithClient(baseurl, username, password, client)
+}
+
+// LoadServicesWithClient loads the services tree from an device using the given http client for all requests.
+func LoadServicesWithClient(baseurl string, username string, password string, client *http.Client) (*Root, error) {
+
 	var root = &Root{
 		BaseURL:  baseurl,
 		Username: username,
 		Password: password,
+		client:   client,
 	}
 
 	err := root.load()
@@ -523,6 +682,7 @@ func LoadServices(baseurl string, username string, password string, verifyTls bo
 		BaseURL:  baseurl,
 		Username: username,
 		Password: password,
+		client:   client,
 	}
 
 	err = rootTr64.loadTr64()
@@ -533,6 +693,18 @@ func LoadServices(baseurl string, username string, password string, verifyTls bo
 	for k, v := range rootTr64.Services {
 		root.Services[k] = v
 	}
+	root.SystemVersion = rootTr64.SystemVersion
+
+	// all actions share the authentication and handlers of root
+	rootTr64.Device.setRoot(root)
 
 	return root, nil
 }
+
+// setRoot sets the root of the device and its sub devices
+func (d *Device) setRoot(r *Root) {
+	d.root = r
+	for _, d2 := range d.Devices {
+		d2.setRoot(r)
+	}
+}
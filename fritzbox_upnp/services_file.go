@@ -0,0 +1,68 @@
+package fritzbox_upnp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+)
+
+// servicesFile JSON struct for storing the services tree
+type servicesFile struct {
+	Device   Device              `json:"device"` // only device info, sub devices and services are stored in Services
+	Services map[string]*Service `json:"services"`
+
+	SystemVersion *SystemVersion `json:"systemVersion,omitempty"`
+}
+
+// SaveServices stores the services tree as JSON file, so it can be used without the device (e.g. for validating metrics)
+func (r *Root) SaveServices(file string) error {
+	sf := servicesFile{
+		Device:   r.Device,
+		Services: r.Services,
+
+		SystemVersion: r.SystemVersion,
+	}
+	sf.Device.Services = nil
+	sf.Device.Devices = nil
+
+	data, err := json.MarshalIndent(sf, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(file, data, 0644)
+}
+
+// LoadServicesFromFile loads a services tree stored by SaveServices.
+// Actions of the tree are called using baseurl and the given credentials and client.
+func LoadServicesFromFile(file string, baseurl string, username string, password string, client *http.Client) (*Root, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var sf servicesFile
+	err = json.Unmarshal(data, &sf)
+	if err != nil {
+		return nil, err
+	}
+
+	var root = &Root{
+		BaseURL:  baseurl,
+		Username: username,
+		Password: password,
+		Device:   sf.Device,
+		Services: sf.Services,
+		client:   client,
+
+		SystemVersion: sf.SystemVersion,
+	}
+	root.Device.root = root
+
+	for _, s := range root.Services {
+		s.Device = &root.Device
+		s.linkActions()
+	}
+
+	return root, nil
+}
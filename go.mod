@@ -6,7 +6,8 @@ require (
 	github.com/heptiolabs/healthcheck v0.0.0-20180807145615-6ff867650f40
 	github.com/namsral/flag v1.7.4-pre
 	github.com/prometheus/client_golang v1.10.0
+	github.com/prometheus/client_model v0.2.0
+	github.com/sirupsen/logrus v1.6.0
 	golang.org/x/text v0.3.6
-	github.com/sirupsen/logrus v1.4.2
 	gopkg.in/DATA-DOG/go-sqlmock.v1 v1.3.0 // indirect
 )
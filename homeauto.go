@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	homeauto "github.com/sberk42/fritzbox_exporter/fritzbox_homeauto"
+	upnp "github.com/sberk42/fritzbox_exporter/fritzbox_upnp"
+)
+
+const (
+	homeautoService = "urn:dslforum-org:service:X_AVM-DE_Homeauto:1"
+
+	// TTL of the device infos, each device is loaded with a separate call
+	homeautoTTL = minCacheTTL
+
+	// limit of devices loaded, the list ends with an invalid index error
+	maxHomeautoDevices = 256
+)
+
+var (
+	homeautoInfoDesc = prometheus.NewDesc(
+		"gateway_homeauto_device_info",
+		"Smart home device of the FRITZ!Box, value is always 1.",
+		[]string{"gateway", "ain", "name", "product", "manufacturer", "firmware"},
+		nil,
+	)
+	homeautoPresentDesc = prometheus.NewDesc(
+		"gateway_homeauto_device_present",
+		"Whether the smart home device is connected.",
+		[]string{"gateway", "ain", "name"},
+		nil,
+	)
+	homeautoTemperatureDesc = prometheus.NewDesc(
+		"gateway_homeauto_temperature_celsius",
+		"Temperature measured by the smart home device including its offset.",
+		[]string{"gateway", "ain", "name"},
+		nil,
+	)
+	homeautoSwitchDesc = prometheus.NewDesc(
+		"gateway_homeauto_switch_on",
+		"Whether the switch of the smart home device is on.",
+		[]string{"gateway", "ain", "name"},
+		nil,
+	)
+	homeautoPowerDesc = prometheus.NewDesc(
+		"gateway_homeauto_power_watts",
+		"Current power measured by the smart home device.",
+		[]string{"gateway", "ain", "name"},
+		nil,
+	)
+	homeautoEnergyDesc = prometheus.NewDesc(
+		"gateway_homeauto_energy_joules_total",
+		"Energy measured by the smart home device since it was reset.",
+		[]string{"gateway", "ain", "name"},
+		nil,
+	)
+	homeautoThermostatCurrentDesc = prometheus.NewDesc(
+		"gateway_homeauto_thermostat_current_celsius",
+		"Temperature measured by the thermostat.",
+		[]string{"gateway", "ain", "name"},
+		nil,
+	)
+	homeautoThermostatTargetDesc = prometheus.NewDesc(
+		"gateway_homeauto_thermostat_target_celsius",
+		"Target temperature of the thermostat, not reported if the valve is set to open or closed.",
+		[]string{"gateway", "ain", "name"},
+		nil,
+	)
+	homeautoBatteryDesc = prometheus.NewDesc(
+		"gateway_homeauto_battery_ratio",
+		"Charge of the battery of the smart home device.",
+		[]string{"gateway", "ain", "name"},
+		nil,
+	)
+	homeautoBatteryLowDesc = prometheus.NewDesc(
+		"gateway_homeauto_battery_low",
+		"Whether the battery of the smart home device is low.",
+		[]string{"gateway", "ain", "name"},
+		nil,
+	)
+	homeautoAlertDesc = prometheus.NewDesc(
+		"gateway_homeauto_alert",
+		"Whether the alarm sensor of the smart home device reports an alert.",
+		[]string{"gateway", "ain", "name"},
+		nil,
+	)
+)
+
+// homeautoCollector reports the smart home devices returned by GetGenericDeviceInfos. Battery and alert state are not
+// returned by TR-064, they are taken from the device list of the smart home API if another collector uses the lua API.
+type homeautoCollector struct{}
+
+func newHomeautoCollector() subCollector {
+	return &homeautoCollector{}
+}
+
+func (hc *homeautoCollector) collect(fc *FritzboxCollector, sc *scrape, ch chan<- prometheus.Metric) {
+	states := hc.getStates(fc, sc)
+
+	for index := 0; index < maxHomeautoDevices; index++ {
+		device, err := hc.getDevice(fc, sc, index)
+		if err != nil {
+			logCollectError("smart home device "+strconv.Itoa(index), err)
+			return
+		}
+		if device == nil {
+			return
+		}
+
+		reportHomeautoDevice(fc.Gateway, device, states[homeautoAINKey(homeautoString(device, "AIN"))], ch)
+	}
+}
+
+// getStates returns the devices of the smart home API by AIN, nil if no lua session is configured or the device list
+// can't be loaded
+func (hc *homeautoCollector) getStates(fc *FritzboxCollector, sc *scrape) map[string]*homeauto.Device {
+	if fc.LuaSession == nil {
+		return nil
+	}
+
+	client := &homeauto.Client{Session: fc.LuaSession}
+
+	// same cache entry as the collector homeautoswitch
+	list, err := fc.loadHomeauto(sc, "getdevicelistinfos", "", minCacheTTL, func() (interface{}, error) {
+		return client.GetDeviceListInfos()
+	})
+	if err != nil {
+		logCollectError("battery and alert state of smart home devices", err)
+		return nil
+	}
+
+	states := make(map[string]*homeauto.Device)
+	for _, d := range list.(*homeauto.DeviceList).Devices {
+		states[homeautoAINKey(d.AIN)] = d
+	}
+	return states
+}
+
+// homeautoAINKey AIN without spaces, as TR-064 and the smart home API may format it differently
+func homeautoAINKey(ain string) string {
+	return strings.ReplaceAll(ain, " ", "")
+}
+
+// getDevice returns the results of GetGenericDeviceInfos for the index by argument name, nil after the last device
+func (hc *homeautoCollector) getDevice(fc *FritzboxCollector, sc *scrape, index int) (map[string]interface{}, error) {
+	const actionName = "GetGenericDeviceInfos"
+
+	result, duration, err := fc.loadActionResult(sc, homeautoService, actionName, homeautoTTL, &upnp.ActionArgument{Name: "NewIndex", Value: index})
+
+	var sfe *upnp.SoapFaultError
+	if errors.As(err, &sfe) && sfe.Code == upnp.ErrorCodeArrayIndexInvalid {
+		// end of the device list
+		fc.recordActionResult(sc, homeautoService, actionName, duration, nil)
+		return nil, nil
+	}
+
+	fc.recordActionResult(sc, homeautoService, actionName, duration, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return fc.argumentResults(homeautoService, actionName, result), nil
+}
+
+// reportHomeautoDevice reports the values of the functions the device supports and which are valid, battery and alert
+// are reported from state if the device is present
+func reportHomeautoDevice(gateway string, device map[string]interface{}, state *homeauto.Device, ch chan<- prometheus.Metric) {
+	ain := homeautoString(device, "AIN")
+	name := sanitizeLabelValue(homeautoString(device, "DeviceName"))
+
+	ch <- prometheus.MustNewConstMetric(homeautoInfoDesc, prometheus.GaugeValue, 1, gateway, ain, name,
+		sanitizeLabelValue(homeautoString(device, "ProductName")),
+		sanitizeLabelValue(homeautoString(device, "Manufacturer")),
+		sanitizeLabelValue(homeautoString(device, "FirmwareVersion")))
+
+	present := 0.0
+	if homeautoString(device, "Present") == "CONNECTED" {
+		present = 1
+	}
+	ch <- prometheus.MustNewConstMetric(homeautoPresentDesc, prometheus.GaugeValue, present, gateway, ain, name)
+
+	report := func(desc *prometheus.Desc, valueType prometheus.ValueType, result string, factor float64) {
+		value, err := resultValue(device[result], "")
+		if err != nil {
+			logCollectError(fmt.Sprintf("%s of smart home device %s", result, ain), err)
+			return
+		}
+		ch <- prometheus.MustNewConstMetric(desc, valueType, value*factor, gateway, ain, name)
+	}
+
+	if homeautoValid(device, "Temperature") {
+		report(homeautoTemperatureDesc, prometheus.GaugeValue, "TemperatureCelsius", 0.1)
+	}
+
+	if homeautoValid(device, "Switch") {
+		on := 0.0
+		if homeautoString(device, "SwitchState") == "ON" {
+			on = 1
+		}
+		ch <- prometheus.MustNewConstMetric(homeautoSwitchDesc, prometheus.GaugeValue, on, gateway, ain, name)
+	}
+
+	if homeautoValid(device, "Multimeter") {
+		// power in 1/100 W and energy in Wh
+		report(homeautoPowerDesc, prometheus.GaugeValue, "MultimeterPower", 0.01)
+		report(homeautoEnergyDesc, prometheus.CounterValue, "MultimeterEnergy", unitFactors["Wh"])
+	}
+
+	if homeautoValid(device, "Hkr") {
+		report(homeautoThermostatCurrentDesc, prometheus.GaugeValue, "HkrIsTemperature", 0.1)
+		if homeautoString(device, "HkrSetVentilStatus") == "TEMP" {
+			report(homeautoThermostatTargetDesc, prometheus.GaugeValue, "HkrSetTemperature", 0.1)
+		}
+	}
+
+	reportHomeautoState(gateway, ain, name, state, ch)
+}
+
+// reportHomeautoState reports battery and alert of the device of the smart home API if it is present
+func reportHomeautoState(gateway string, ain string, name string, state *homeauto.Device, ch chan<- prometheus.Metric) {
+	if state == nil || !state.Present {
+		return
+	}
+
+	report := func(desc *prometheus.Desc, value float64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, gateway, ain, name)
+	}
+
+	battery, batteryLow := state.Battery, state.BatteryLow
+	if battery == nil && state.Thermostat != nil {
+		// battery of thermostats is only reported in the section of the thermostat by older versions
+		battery, batteryLow = &state.Thermostat.Battery, &state.Thermostat.BatteryLow
+	}
+	if battery != nil {
+		report(homeautoBatteryDesc, float64(*battery)/100)
+	}
+	if batteryLow != nil {
+		report(homeautoBatteryLowDesc, homeautoBool(*batteryLow))
+	}
+
+	if state.Alert != nil && state.Alert.State != "" {
+		report(homeautoAlertDesc, homeautoBool(state.Alert.State != "0"))
+	}
+}
+
+func homeautoBool(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// homeautoValid checks whether the function is enabled and its values are valid
+func homeautoValid(device map[string]interface{}, function string) bool {
+	return homeautoString(device, function+"IsEnabled") == "ENABLED" && homeautoString(device, function+"IsValid") == "VALID"
+}
+
+func homeautoString(device map[string]interface{}, result string) string {
+	value, ok := device[result]
+	if !ok {
+		return ""
+	}
+	return formatValue(value)
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	homeauto "github.com/sberk42/fritzbox_exporter/fritzbox_homeauto"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	homeautoSwitchPage = "webservices/homeautoswitch.lua"
+
+	// TTL of the device stats, the series with the smallest grid cover an hour
+	homeautoStatsTTL = 300
+)
+
+var homeautoSwitchLabels = []string{"gateway", "ain", "name"}
+
+// values of the devices not provided by TR-064, battery and alert are reported with the descs of the collector homeauto
+var (
+	homeautoHumidityDesc = prometheus.NewDesc(
+		"gateway_homeauto_humidity_ratio",
+		"Relative humidity measured by the smart home device.",
+		homeautoSwitchLabels,
+		nil,
+	)
+	homeautoVoltageDesc = prometheus.NewDesc(
+		"gateway_homeauto_voltage_volts",
+		"Current voltage measured by the smart home device.",
+		homeautoSwitchLabels,
+		nil,
+	)
+	homeautoAlertChangeDesc = prometheus.NewDesc(
+		"gateway_homeauto_alert_last_change_timestamp_seconds",
+		"Time of the last change of the alert state.",
+		homeautoSwitchLabels,
+		nil,
+	)
+	homeautoWindowOpenDesc = prometheus.NewDesc(
+		"gateway_homeauto_thermostat_window_open",
+		"Whether the thermostat detected an open window.",
+		homeautoSwitchLabels,
+		nil,
+	)
+)
+
+// statsKind series of getbasicdevicestats reported as metric
+type statsKind struct {
+	name   string
+	help   string
+	scale  func(value float64) float64 // converts to the base unit
+	series func(stats *homeauto.DeviceStats) []*homeauto.Stats
+	desc   *prometheus.Desc
+}
+
+var statsKinds = []*statsKind{
+	{
+		name:   "gateway_homeauto_stats_temperature_celsius",
+		help:   "Temperature stored by the FRITZ!Box for the smart home device.",
+		scale:  func(value float64) float64 { return value / 10 },
+		series: func(stats *homeauto.DeviceStats) []*homeauto.Stats { return stats.Temperature },
+	},
+	{
+		name:   "gateway_homeauto_stats_humidity_ratio",
+		help:   "Relative humidity stored by the FRITZ!Box for the smart home device.",
+		scale:  func(value float64) float64 { return value / 100 },
+		series: func(stats *homeauto.DeviceStats) []*homeauto.Stats { return stats.Humidity },
+	},
+	{
+		name:   "gateway_homeauto_stats_voltage_volts",
+		help:   "Voltage stored by the FRITZ!Box for the smart home device.",
+		scale:  func(value float64) float64 { return value / 1000 },
+		series: func(stats *homeauto.DeviceStats) []*homeauto.Stats { return stats.Voltage },
+	},
+	{
+		name:   "gateway_homeauto_stats_power_watts",
+		help:   "Power stored by the FRITZ!Box for the smart home device.",
+		scale:  func(value float64) float64 { return value / 100 },
+		series: func(stats *homeauto.DeviceStats) []*homeauto.Stats { return stats.Power },
+	},
+	{
+		name:   "gateway_homeauto_stats_energy_joules",
+		help:   "Energy consumed by the smart home device within the grid interval stored by the FRITZ!Box.",
+		scale:  func(value float64) float64 { return value * unitFactors["Wh"] },
+		series: func(stats *homeauto.DeviceStats) []*homeauto.Stats { return stats.Energy },
+	},
+}
+
+func init() {
+	for _, kind := range statsKinds {
+		kind.desc = prometheus.NewDesc(kind.name, kind.help+" The sample is the newest value with its time, grid is the distance of the values in seconds.",
+			append(homeautoSwitchLabels, "grid"), nil)
+	}
+}
+
+// homeautoSwitchCollector reports the values of the smart home devices TR-064 does not provide and their stored values
+// of the smart home API
+type homeautoSwitchCollector struct{}
+
+func newHomeautoSwitchCollector() subCollector {
+	return &homeautoSwitchCollector{}
+}
+
+// homeautoDevice device with its stats, stats are nil if the device is not present or loading them failed
+type homeautoDevice struct {
+	*homeauto.Device
+	stats *homeauto.DeviceStats
+}
+
+func (hc *homeautoSwitchCollector) collect(fc *FritzboxCollector, sc *scrape, ch chan<- prometheus.Metric) {
+	devices, err := fc.getHomeautoDevices(sc, homeautoStatsTTL)
+	if err != nil {
+		logCollectError("smart home devices", err)
+		return
+	}
+
+	now := time.Now()
+	for _, d := range devices {
+		reportHomeautoSwitchDevice(fc.Gateway, d.Device, ch)
+
+		if d.stats == nil {
+			continue
+		}
+
+		name := sanitizeLabelValue(d.Name)
+		for _, kind := range statsKinds {
+			for _, s := range kind.series(d.stats) {
+				// the time of the values is unknown if the FRITZ!Box does not send it
+				if s.DataTime == 0 {
+					continue
+				}
+
+				samples := s.Samples(now)
+				if len(samples) == 0 {
+					continue
+				}
+
+				newest := samples[len(samples)-1]
+				m := prometheus.MustNewConstMetric(kind.desc, prometheus.GaugeValue, kind.scale(newest.Value), fc.Gateway, d.AIN, name, strconv.Itoa(s.Grid))
+				ch <- prometheus.NewMetricWithTimestamp(newest.Time, m)
+			}
+		}
+	}
+}
+
+// getHomeautoDevices loads the device list and the stats of all present devices, stats are cached for statsTTL
+// seconds
+func (fc *FritzboxCollector) getHomeautoDevices(sc *scrape, statsTTL int64) ([]*homeautoDevice, error) {
+	client := &homeauto.Client{Session: fc.LuaSession}
+
+	list, err := fc.loadHomeauto(sc, "getdevicelistinfos", "", minCacheTTL, func() (interface{}, error) {
+		return client.GetDeviceListInfos()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]*homeautoDevice, 0, len(list.(*homeauto.DeviceList).Devices))
+	var wg sync.WaitGroup
+	for _, device := range list.(*homeauto.DeviceList).Devices {
+		d := &homeautoDevice{Device: device}
+		devices = append(devices, d)
+		if !device.Present {
+			continue
+		}
+
+		wg.Add(1)
+		go func(d *homeautoDevice) {
+			defer wg.Done()
+
+			stats, err := fc.loadHomeauto(sc, "getbasicdevicestats", d.AIN, statsTTL, func() (interface{}, error) {
+				return client.GetBasicDeviceStats(d.AIN)
+			})
+			if err != nil {
+				logCollectError("stats of smart home device "+d.AIN, err)
+				return
+			}
+			d.stats = stats.(*homeauto.DeviceStats)
+		}(d)
+	}
+	wg.Wait()
+
+	return devices, nil
+}
+
+// loadHomeauto gets the result of the command from cache or loads it using one of the workers
+func (fc *FritzboxCollector) loadHomeauto(sc *scrape, command string, ain string, ttl int64, load func() (interface{}, error)) (interface{}, error) {
+	var duration time.Duration // stays 0 if cached
+	result, err := fc.luaCache.get(homeautoSwitchPage+"_"+command+"_"+ain, ttl, func() (interface{}, error) {
+		sc.workers <- struct{}{}
+		start := time.Now()
+		result, err := load()
+		duration = time.Since(start)
+		<-sc.workers
+
+		if err != nil {
+			fc.LuaSession.ClearSID() // clear SID in case of error, so force reauthentication
+			return nil, fmt.Errorf("error calling %s %s: %w", homeautoSwitchPage, command, err)
+		}
+		return result, nil
+	})
+
+	sc.stats.record(luaService, homeautoSwitchPage+"?switchcmd="+command, duration, err, "")
+	return result, err
+}
+
+// reportHomeautoSwitchDevice reports the current values of the device not provided by TR-064, nothing if it is not
+// connected
+func reportHomeautoSwitchDevice(gateway string, d *homeauto.Device, ch chan<- prometheus.Metric) {
+	if !d.Present {
+		return
+	}
+
+	name := sanitizeLabelValue(d.Name)
+	report := func(desc *prometheus.Desc, value float64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, gateway, d.AIN, name)
+	}
+
+	reportHomeautoState(gateway, d.AIN, name, d, ch)
+
+	if d.Humidity != nil {
+		report(homeautoHumidityDesc, float64(d.Humidity.Relative)/100)
+	}
+
+	if d.PowerMeter != nil {
+		report(homeautoVoltageDesc, float64(d.PowerMeter.Voltage)/1000)
+	}
+
+	if d.Alert != nil && d.Alert.State != "" && d.Alert.LastChange > 0 {
+		report(homeautoAlertChangeDesc, float64(d.Alert.LastChange))
+	}
+
+	if d.Thermostat != nil {
+		report(homeautoWindowOpenDesc, homeautoBool(d.Thermostat.WindowOpen))
+	}
+}
+
+// homeautoStatsHandler writes all values stored by the FRITZ!Box for the smart home devices of the target in
+// OpenMetrics format, so gaps can be backfilled with promtool tsdb create-blocks-from openmetrics.
+// The optional parameters job and instance are added as labels to match the scraped series.
+func homeautoStatsHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	target := params.Get("target")
+	if target == "" {
+		target = probeTargets.defaultTarget()
+	}
+
+	fc, err := probeTargets.get(target, moduleDefault)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := fc.subCollectors[collectorHomeautoSwitch]; !ok {
+		http.Error(w, fmt.Sprintf("collector %s is not enabled for target '%s'", collectorHomeautoSwitch, target), http.StatusBadRequest)
+		return
+	}
+
+	sc := &scrape{
+		workers: make(chan struct{}, fc.workers),
+		stats:   newScrapeStats(),
+	}
+
+	// always load the latest stats
+	devices, err := fc.getHomeautoDevices(sc, 0)
+	if err != nil {
+		logrus.Warnf("can not load smart home devices of %s: %s", target, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	var extraLabels string
+	for _, name := range []string{"job", "instance"} {
+		if value := params.Get(name); value != "" {
+			extraLabels += fmt.Sprintf(`,%s="%s"`, name, escapeOpenMetricsLabel(value))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i].AIN < devices[j].AIN })
+	now := time.Now()
+	for _, kind := range statsKinds {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s gauge\n", kind.name, kind.help, kind.name)
+
+		for _, d := range devices {
+			if d.stats == nil {
+				continue
+			}
+
+			for _, s := range kind.series(d.stats) {
+				// the time of the values is unknown if the FRITZ!Box does not send it
+				if s.DataTime == 0 {
+					continue
+				}
+
+				labels := fmt.Sprintf(`gateway="%s",ain="%s",name="%s",grid="%d"%s`, escapeOpenMetricsLabel(fc.Gateway),
+					escapeOpenMetricsLabel(d.AIN), escapeOpenMetricsLabel(sanitizeLabelValue(d.Name)), s.Grid, extraLabels)
+				for _, sample := range s.Samples(now) {
+					fmt.Fprintf(bw, "%s{%s} %g %d\n", kind.name, labels, kind.scale(sample.Value), sample.Time.Unix())
+				}
+			}
+		}
+	}
+	fmt.Fprint(bw, "# EOF\n")
+}
+
+var openMetricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeOpenMetricsLabel(value string) string {
+	return openMetricsLabelEscaper.Replace(value)
+}
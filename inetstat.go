@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	lua "github.com/sberk42/fritzbox_exporter/fritzbox_lua"
+)
+
+const (
+	// distance of the samples of the online monitor
+	inetstatSampleInterval = 5 * time.Second
+
+	// TTL of the online monitor, the page is updated with every sample
+	inetstatTTL = 5
+
+	// samples of the peak rate (one minute), a fixed window so it does not depend on the scrape interval
+	inetstatPeakSamples = 12
+)
+
+var inetstatPage = lua.LuaPage{Path: "GET:internet/inetstat_monitor.lua", Params: "action=get_graphic&useajax=1&xhr=1"}
+
+// series of the online monitor by traffic class, the values are bytes per second, the newest sample first
+var inetstatSeries = []struct {
+	key       string
+	direction string
+	class     string
+}{
+	{"ds_bps_curr", "down", "default"},
+	{"ds_mc_bps_curr", "down", "iptv"},
+	{"ds_guest_bps_curr", "down", "guest"},
+	{"us_default_bps_curr", "up", "default"},
+	{"us_realtime_bps_curr", "up", "realtime"},
+	{"us_important_bps_curr", "up", "important"},
+	{"us_background_bps_curr", "up", "background"},
+	{"us_guest_bps_curr", "up", "guest"},
+}
+
+var (
+	inetstatRateDesc = prometheus.NewDesc(
+		"gateway_inetstat_rate_bytes_per_second",
+		"Current throughput of the internet connection by traffic class (newest sample of the online monitor).",
+		[]string{"gateway", "direction", "class"},
+		nil,
+	)
+	inetstatPeakDesc = prometheus.NewDesc(
+		"gateway_inetstat_peak_rate_bytes_per_second",
+		"Highest sample of the online monitor within the last minute by traffic class.",
+		[]string{"gateway", "direction", "class"},
+		nil,
+	)
+	inetstatBytesDesc = prometheus.NewDesc(
+		"gateway_inetstat_bytes_total",
+		"Bytes transferred over the internet connection by traffic class, summed up from the samples of the online monitor.",
+		[]string{"gateway", "direction", "class"},
+		nil,
+	)
+)
+
+// inetstatCollector reports the traffic of the online monitor and counts the bytes of all samples loaded
+type inetstatCollector struct {
+	sync.Mutex
+	samples map[string][]float64 // series of the last load by key, nil before the first load
+	loaded  time.Time            // time of the last load
+	bytes   map[string]float64   // bytes of the samples counted by key
+}
+
+func newInetstatCollector() subCollector {
+	return &inetstatCollector{bytes: make(map[string]float64)}
+}
+
+func (ic *inetstatCollector) collect(fc *FritzboxCollector, sc *scrape, ch chan<- prometheus.Metric) {
+	// samples are counted when the page is loaded, so reading it from cache does not count them again
+	data, err := fc.loadLuaPage(sc, inetstatPage, inetstatTTL, "inetstat", func(pageData []byte) (interface{}, error) {
+		var data interface{}
+		err := json.Unmarshal(pageData, &data)
+		if err != nil {
+			return nil, err
+		}
+
+		series := parseInetstatSeries(data)
+		if series != nil {
+			ic.count(series, time.Now())
+		}
+		return series, nil
+	})
+	if err != nil {
+		logCollectError("online monitor", err)
+		return
+	}
+
+	series := data.(map[string][]float64)
+	if series == nil {
+		err = fmt.Errorf("%s has no %s", inetstatPage.Path, inetstatSeries[0].key)
+		sc.stats.record(luaService, inetstatPage.Path+"?"+inetstatPage.Params, 0, err, causeMissingResult)
+		logCollectError("online monitor", err)
+		return
+	}
+
+	ic.Lock()
+	defer ic.Unlock()
+
+	for _, s := range inetstatSeries {
+		samples, ok := series[s.key]
+		if !ok {
+			continue
+		}
+
+		if !math.IsNaN(samples[0]) {
+			ch <- prometheus.MustNewConstMetric(inetstatRateDesc, prometheus.GaugeValue, samples[0], fc.Gateway, s.direction, s.class)
+		}
+
+		if peak, ok := inetstatPeak(samples); ok {
+			ch <- prometheus.MustNewConstMetric(inetstatPeakDesc, prometheus.GaugeValue, peak, fc.Gateway, s.direction, s.class)
+		}
+
+		ch <- prometheus.MustNewConstMetric(inetstatBytesDesc, prometheus.CounterValue, ic.bytes[s.key], fc.Gateway, s.direction, s.class)
+	}
+}
+
+// parseInetstatSeries returns the series of the page which have samples by key, nil if the page has no series
+func parseInetstatSeries(data interface{}) map[string][]float64 {
+	// the page returns an array with one object for the connection, the object itself is matched as well
+	values, ok := findJSONValue([]interface{}{data}, func(key string, value interface{}) bool {
+		m, isMap := value.(map[string]interface{})
+		return isMap && m[inetstatSeries[0].key] != nil
+	})
+	if !ok {
+		return nil
+	}
+
+	series := make(map[string][]float64)
+	for _, s := range inetstatSeries {
+		if samples := parseNumberList(values.(map[string]interface{})[s.key]); len(samples) > 0 {
+			series[s.key] = samples
+		}
+	}
+	return series
+}
+
+// inetstatPeak returns the highest sample within the window, false if there is none
+func inetstatPeak(samples []float64) (float64, bool) {
+	if len(samples) > inetstatPeakSamples {
+		samples = samples[:inetstatPeakSamples]
+	}
+
+	peak, found := 0.0, false
+	for _, sample := range samples {
+		if !math.IsNaN(sample) && (!found || sample > peak) {
+			peak, found = sample, true
+		}
+	}
+	return peak, found
+}
+
+// count adds the bytes of the samples taken since the previous load, the first load only sets the start
+func (ic *inetstatCollector) count(series map[string][]float64, now time.Time) {
+	ic.Lock()
+	defer ic.Unlock()
+
+	if ic.samples != nil {
+		estimate := int(math.Round(float64(now.Sub(ic.loaded)) / float64(inetstatSampleInterval)))
+		n := inetstatNewSamples(ic.samples, series, estimate)
+		for key, samples := range series {
+			if n < len(samples) {
+				samples = samples[:n]
+			}
+			for _, sample := range samples {
+				if !math.IsNaN(sample) {
+					ic.bytes[key] += sample * inetstatSampleInterval.Seconds()
+				}
+			}
+		}
+	}
+
+	ic.samples = series
+	ic.loaded = now
+}
+
+// inetstatNewSamples returns the number of samples added in front of the previous series. Of the shifts the series
+// match the previous ones with, the one closest to the estimate from the time between the loads is used, a shift by
+// the whole length always matches.
+func inetstatNewSamples(previous map[string][]float64, current map[string][]float64, estimate int) int {
+	length := 0
+	for _, samples := range current {
+		if len(samples) > length {
+			length = len(samples)
+		}
+	}
+
+	best := length
+	for shift := 0; shift < length; shift++ {
+		if inetstatShiftMatches(previous, current, shift) && absInt(shift-estimate) < absInt(best-estimate) {
+			best = shift
+		}
+	}
+	return best
+}
+
+// inetstatShiftMatches checks if the samples of the current series after shift equal the previous ones
+func inetstatShiftMatches(previous map[string][]float64, current map[string][]float64, shift int) bool {
+	for key, samples := range current {
+		prev := previous[key]
+		for i := shift; i < len(samples) && i-shift < len(prev); i++ {
+			cur, old := samples[i], prev[i-shift]
+			if cur != old && !(math.IsNaN(cur) && math.IsNaN(old)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func absInt(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestInetstatNewSamples(t *testing.T) {
+	nan := math.NaN()
+
+	tests := []struct {
+		name     string
+		previous map[string][]float64
+		current  map[string][]float64
+		estimate int
+		want     int
+	}{
+		{
+			name:     "unchanged",
+			previous: map[string][]float64{"ds": {3, 2, 1, 0}},
+			current:  map[string][]float64{"ds": {3, 2, 1, 0}},
+			estimate: 0,
+			want:     0,
+		},
+		{
+			name:     "two new samples",
+			previous: map[string][]float64{"ds": {3, 2, 1, 0}},
+			current:  map[string][]float64{"ds": {5, 4, 3, 2}},
+			estimate: 2,
+			want:     2,
+		},
+		{
+			name:     "content corrects the estimate",
+			previous: map[string][]float64{"ds": {3, 2, 1, 0}},
+			current:  map[string][]float64{"ds": {4, 3, 2, 1}},
+			estimate: 2,
+			want:     1,
+		},
+		{
+			name:     "all series must match",
+			previous: map[string][]float64{"ds": {0, 0, 0, 0}, "us": {3, 2, 1, 0}},
+			current:  map[string][]float64{"ds": {0, 0, 0, 0}, "us": {5, 4, 3, 2}},
+			estimate: 1,
+			want:     2,
+		},
+		{
+			name:     "idle line uses the estimate",
+			previous: map[string][]float64{"ds": {0, 0, 0, 0}},
+			current:  map[string][]float64{"ds": {0, 0, 0, 0}},
+			estimate: 3,
+			want:     3,
+		},
+		{
+			name:     "missing samples",
+			previous: map[string][]float64{"ds": {3, nan, 1, 0}},
+			current:  map[string][]float64{"ds": {4, 3, nan, 1}},
+			estimate: 1,
+			want:     1,
+		},
+		{
+			name:     "no overlap",
+			previous: map[string][]float64{"ds": {3, 2, 1, 0}},
+			current:  map[string][]float64{"ds": {9, 8, 7, 6}},
+			estimate: 2,
+			want:     4,
+		},
+		{
+			name:     "load after a long pause",
+			previous: map[string][]float64{"ds": {0, 0, 0, 0}},
+			current:  map[string][]float64{"ds": {0, 0, 0, 0}},
+			estimate: 100,
+			want:     4,
+		},
+		{
+			name:     "new series",
+			previous: map[string][]float64{"ds": {3, 2, 1, 0}},
+			current:  map[string][]float64{"ds": {4, 3, 2, 1}, "us": {1, 1, 1, 1}},
+			estimate: 1,
+			want:     1,
+		},
+	}
+
+	for _, tt := range tests {
+		if got := inetstatNewSamples(tt.previous, tt.current, tt.estimate); got != tt.want {
+			t.Errorf("%s: got %d new samples, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestInetstatCollectorCount(t *testing.T) {
+	type load struct {
+		after  time.Duration // since the first load
+		series map[string][]float64
+	}
+
+	tests := []struct {
+		name  string
+		loads []load
+		bytes float64 // counted bytes of the series "ds"
+	}{
+		{
+			name:  "first load only sets the start",
+			loads: []load{{0, map[string][]float64{"ds": {3, 2, 1, 0}}}},
+		},
+		{
+			name: "new samples counted once",
+			loads: []load{
+				{0, map[string][]float64{"ds": {3, 2, 1, 0}}},
+				{10 * time.Second, map[string][]float64{"ds": {5, 4, 3, 2}}},
+				{15 * time.Second, map[string][]float64{"ds": {6, 5, 4, 3}}},
+			},
+			bytes: (5 + 4 + 6) * 5,
+		},
+		{
+			name: "same samples loaded again",
+			loads: []load{
+				{0, map[string][]float64{"ds": {3, 2, 1, 0}}},
+				{4 * time.Second, map[string][]float64{"ds": {3, 2, 1, 0}}},
+			},
+		},
+		{
+			name: "sample taken shortly after the load",
+			loads: []load{
+				{0, map[string][]float64{"ds": {3, 2, 1, 0}}},
+				{7 * time.Second, map[string][]float64{"ds": {5, 4, 3, 2}}},
+			},
+			bytes: (5 + 4) * 5,
+		},
+		{
+			name: "missing samples skipped",
+			loads: []load{
+				{0, map[string][]float64{"ds": {3, 2, 1, 0}}},
+				{10 * time.Second, map[string][]float64{"ds": {math.NaN(), 4, 3, 2}}},
+			},
+			bytes: 4 * 5,
+		},
+	}
+
+	start := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		ic := newInetstatCollector().(*inetstatCollector)
+		for _, l := range tt.loads {
+			ic.count(l.series, start.Add(l.after))
+		}
+
+		if got := ic.bytes["ds"]; got != tt.bytes {
+			t.Errorf("%s: got %v bytes, want %v", tt.name, got, tt.bytes)
+		}
+	}
+}
+
+func TestInetstatPeak(t *testing.T) {
+	nan := math.NaN()
+
+	tests := []struct {
+		name    string
+		samples []float64
+		want    float64
+		ok      bool
+	}{
+		{"newest sample", []float64{7}, 7, true},
+		{"highest sample", []float64{1, 9, 3}, 9, true},
+		{"older samples outside the window", []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 100}, 12, true},
+		{"missing samples", []float64{nan, 2, nan}, 2, true},
+		{"no sample", []float64{nan, nan}, 0, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := inetstatPeak(tt.samples)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: got %v %v, want %v %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	inventoryService = "urn:dslforum-org:service:Hosts:1"
+	inventoryAction  = "X_AVM-DE_GetHostListPath"
+
+	// TTL of the host list, same as the host metrics
+	inventoryTTL = 60
+
+	// the file is written on new, removed or changed hosts, last seen times only at most once in this interval
+	inventorySaveInterval = 5 * time.Minute
+)
+
+var (
+	inventoryInfoDesc = prometheus.NewDesc(
+		"fritzbox_host_info",
+		"Last IP address, host name and interface type of the host, value is always 1.",
+		[]string{"gateway", "mac", "ip", "hostname", "interface"},
+		nil,
+	)
+	inventoryLastSeenDesc = prometheus.NewDesc(
+		"fritzbox_host_last_seen_timestamp_seconds",
+		"Time the host was last reported active by the FRITZ!Box.",
+		[]string{"gateway", "mac"},
+		nil,
+	)
+	inventoryFirstSeenDesc = prometheus.NewDesc(
+		"fritzbox_host_first_seen_timestamp_seconds",
+		"Time the host was first found in the host list of the FRITZ!Box.",
+		[]string{"gateway", "mac"},
+		nil,
+	)
+	inventoryNewDevicesDesc = prometheus.NewDesc(
+		"fritzbox_host_new_devices_total",
+		"Number of hosts not in the inventory before found since the exporter started.",
+		[]string{"gateway"},
+		nil,
+	)
+)
+
+// inventoryHostList document returned by the URL of X_AVM-DE_GetHostListPath
+type inventoryHostList struct {
+	Items []*inventoryListHost `xml:"Item"`
+}
+
+type inventoryListHost struct {
+	MACAddress    string `xml:"MACAddress"`
+	IPAddress     string `xml:"IPAddress"`
+	HostName      string `xml:"HostName"`
+	InterfaceType string `xml:"InterfaceType"`
+	Active        string `xml:"Active"` // 1 or 0
+}
+
+// inventoryHost host as stored in the inventory file
+type inventoryHost struct {
+	FirstSeen     time.Time `json:"firstSeen"`
+	LastSeen      time.Time `json:"lastSeen"` // zero if never seen active
+	IPAddress     string    `json:"ip"`
+	HostName      string    `json:"hostName"`
+	InterfaceType string    `json:"interfaceType"`
+}
+
+// hostInventory hosts of all gateways stored in the same file by gateway and MAC address
+type hostInventory struct {
+	sync.Mutex
+	Gateways map[string]map[string]*inventoryHost `json:"gateways"`
+
+	file       string
+	saved      time.Time          // time of the last write
+	unsaved    bool               // last seen times changed since the last write
+	newDevices map[string]float64 // hosts found since the exporter started by gateway, counted once for all collectors
+}
+
+// inventories by file, shared by all collectors using the same file
+var (
+	inventoriesMu sync.Mutex
+	inventories   = make(map[string]*hostInventory)
+)
+
+// openHostInventory returns the inventory of the file, it is loaded on first use and empty if the file doesn't exist
+func openHostInventory(file string) (*hostInventory, error) {
+	inventoriesMu.Lock()
+	defer inventoriesMu.Unlock()
+
+	if inv, ok := inventories[file]; ok {
+		return inv, nil
+	}
+
+	inv := &hostInventory{
+		file:       file,
+		Gateways:   make(map[string]map[string]*inventoryHost),
+		newDevices: make(map[string]float64),
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading host inventory: %w", err)
+	}
+	if err == nil {
+		// don't overwrite the file if it can't be parsed
+		err = json.Unmarshal(data, inv)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing host inventory %s: %w", file, err)
+		}
+		if inv.Gateways == nil {
+			inv.Gateways = make(map[string]map[string]*inventoryHost)
+		}
+	}
+
+	inventories[file] = inv
+	return inv, nil
+}
+
+// update adds the hosts not known before, updates the active ones and removes the hosts not seen within retention
+// (if not 0) and counts the new hosts. Hosts of a gateway not in the inventory before are not counted as new.
+func (inv *hostInventory) update(gateway string, hosts []*inventoryListHost, now time.Time, retention time.Duration) error {
+	inv.Lock()
+	defer inv.Unlock()
+
+	known, seeded := inv.Gateways[gateway]
+	if !seeded {
+		known = make(map[string]*inventoryHost)
+		inv.Gateways[gateway] = known
+	}
+
+	changed := !seeded
+	newHosts := 0
+	for _, h := range hosts {
+		mac := strings.ToLower(h.MACAddress)
+		if mac == "" {
+			continue
+		}
+
+		host, ok := known[mac]
+		if !ok {
+			host = &inventoryHost{FirstSeen: now}
+			known[mac] = host
+			newHosts++
+			changed = true
+		}
+
+		if h.Active == "1" || !ok {
+			if host.IPAddress != h.IPAddress || host.HostName != h.HostName || host.InterfaceType != h.InterfaceType {
+				host.IPAddress = h.IPAddress
+				host.HostName = h.HostName
+				host.InterfaceType = h.InterfaceType
+				changed = true
+			}
+		}
+		if h.Active == "1" {
+			host.LastSeen = now
+			inv.unsaved = true
+		}
+	}
+
+	if retention > 0 {
+		for mac, host := range known {
+			if now.Sub(host.lastActivity()) > retention {
+				delete(known, mac)
+				changed = true
+			}
+		}
+	}
+
+	if !seeded {
+		logrus.Infof("host inventory of %s started with %d hosts", gateway, newHosts)
+		newHosts = 0
+	}
+	inv.newDevices[gateway] += float64(newHosts)
+
+	if !changed && !(inv.unsaved && now.Sub(inv.saved) >= inventorySaveInterval) {
+		return nil
+	}
+
+	err := inv.save()
+	if err == nil {
+		inv.saved = now
+		inv.unsaved = false
+	}
+	return err
+}
+
+// lastActivity returns the time the host was last seen active or first found if it was never active
+func (host *inventoryHost) lastActivity() time.Time {
+	if host.LastSeen.IsZero() {
+		return host.FirstSeen
+	}
+	return host.LastSeen
+}
+
+// save writes the inventory to a temporary file and renames it, so the file is never partly written
+func (inv *hostInventory) save() error {
+	data, err := json.MarshalIndent(inv, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding host inventory: %w", err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(inv.file), filepath.Base(inv.file)+".*")
+	if err != nil {
+		return fmt.Errorf("error writing host inventory: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // fails after the rename
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), inv.file)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing host inventory: %w", err)
+	}
+
+	return nil
+}
+
+// report reports the hosts of the gateway and the number of new hosts
+func (inv *hostInventory) report(gateway string, ch chan<- prometheus.Metric) {
+	inv.Lock()
+	defer inv.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(inventoryNewDevicesDesc, prometheus.CounterValue, inv.newDevices[gateway], gateway)
+
+	for mac, host := range inv.Gateways[gateway] {
+		ch <- prometheus.MustNewConstMetric(inventoryInfoDesc, prometheus.GaugeValue, 1, gateway, mac,
+			host.IPAddress, sanitizeLabelValue(host.HostName), host.InterfaceType)
+
+		ch <- prometheus.MustNewConstMetric(inventoryFirstSeenDesc, prometheus.GaugeValue, float64(host.FirstSeen.Unix()), gateway, mac)
+		if !host.LastSeen.IsZero() {
+			ch <- prometheus.MustNewConstMetric(inventoryLastSeenDesc, prometheus.GaugeValue, float64(host.LastSeen.Unix()), gateway, mac)
+		}
+	}
+}
+
+// inventoryCollector keeps every host found in the host list of the FRITZ!Box in the inventory file
+type inventoryCollector struct{}
+
+func newInventoryCollector() subCollector {
+	return &inventoryCollector{}
+}
+
+func (ic *inventoryCollector) collect(fc *FritzboxCollector, sc *scrape, ch chan<- prometheus.Metric) {
+	// retried on every scrape, so a broken file can be fixed without restart
+	inv, err := openHostInventory(fc.hostInventoryFile)
+	if err != nil {
+		logCollectError("host inventory", err)
+		return
+	}
+
+	doc, err := fc.getDocument(sc, inventoryService, inventoryAction, "X_AVM-DE_HostListPath", inventoryTTL)
+	if err != nil {
+		logCollectError("host list", err)
+	} else {
+		var list inventoryHostList
+		err = xml.Unmarshal(doc, &list)
+		if err != nil {
+			err = fmt.Errorf("error parsing host list: %w", err)
+			sc.stats.record(inventoryService, inventoryAction, 0, err, causeParse)
+			logCollectError("host list", err)
+		} else {
+			err = inv.update(fc.Gateway, list.Items, time.Now(), fc.hostInventoryRetention)
+			logCollectError("host inventory", err)
+		}
+	}
+
+	inv.report(fc.Gateway, ch)
+}
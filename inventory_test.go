@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func newTestInventory(t *testing.T) *hostInventory {
+	t.Helper()
+
+	inv, err := openHostInventory(filepath.Join(t.TempDir(), "inventory.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inv
+}
+
+func inventoryMACs(inv *hostInventory, gateway string) []string {
+	macs := make([]string, 0, len(inv.Gateways[gateway]))
+	for mac := range inv.Gateways[gateway] {
+		macs = append(macs, mac)
+	}
+	sort.Strings(macs)
+	return macs
+}
+
+func TestHostInventoryUpdate(t *testing.T) {
+	const gateway = "fritz.box"
+	active := func(mac string, ip string) *inventoryListHost {
+		return &inventoryListHost{MACAddress: mac, IPAddress: ip, HostName: "laptop", InterfaceType: "802.11", Active: "1"}
+	}
+	inactive := func(mac string, ip string) *inventoryListHost {
+		h := active(mac, ip)
+		h.Active = "0"
+		return h
+	}
+
+	type step struct {
+		after time.Duration // since the first update
+		hosts []*inventoryListHost
+	}
+
+	tests := []struct {
+		name       string
+		retention  time.Duration
+		steps      []step
+		macs       []string      // hosts in the inventory after the last step
+		newDevices float64       // new hosts counted for the gateway
+		saved      time.Duration // time of the last write since the first update
+	}{
+		{
+			name:  "seeding",
+			steps: []step{{0, []*inventoryListHost{active("aa", "10.0.0.1"), inactive("bb", "10.0.0.2")}}},
+			macs:  []string{"aa", "bb"},
+		},
+		{
+			name: "new host",
+			steps: []step{
+				{0, []*inventoryListHost{active("aa", "10.0.0.1")}},
+				{time.Minute, []*inventoryListHost{active("aa", "10.0.0.1"), inactive("bb", "10.0.0.2")}},
+			},
+			macs:       []string{"aa", "bb"},
+			newDevices: 1,
+			saved:      time.Minute,
+		},
+		{
+			name: "MAC address case ignored",
+			steps: []step{
+				{0, []*inventoryListHost{active("AA", "10.0.0.1")}},
+				{time.Minute, []*inventoryListHost{active("aa", "10.0.0.1")}},
+			},
+			macs: []string{"aa"},
+		},
+		{
+			name: "last seen not saved within interval",
+			steps: []step{
+				{0, []*inventoryListHost{active("aa", "10.0.0.1")}},
+				{time.Minute, []*inventoryListHost{active("aa", "10.0.0.1")}},
+				{4 * time.Minute, []*inventoryListHost{active("aa", "10.0.0.1")}},
+			},
+			macs: []string{"aa"},
+		},
+		{
+			name: "last seen saved after interval",
+			steps: []step{
+				{0, []*inventoryListHost{active("aa", "10.0.0.1")}},
+				{time.Minute, []*inventoryListHost{active("aa", "10.0.0.1")}},
+				{6 * time.Minute, []*inventoryListHost{inactive("aa", "10.0.0.1")}},
+			},
+			macs:  []string{"aa"},
+			saved: 6 * time.Minute,
+		},
+		{
+			name: "changed IP address saved",
+			steps: []step{
+				{0, []*inventoryListHost{active("aa", "10.0.0.1")}},
+				{time.Minute, []*inventoryListHost{active("aa", "10.0.0.2")}},
+			},
+			macs:  []string{"aa"},
+			saved: time.Minute,
+		},
+		{
+			name: "IP address of inactive host kept",
+			steps: []step{
+				{0, []*inventoryListHost{inactive("aa", "10.0.0.1")}},
+				{time.Minute, []*inventoryListHost{inactive("aa", "10.0.0.2")}},
+			},
+			macs: []string{"aa"},
+		},
+		{
+			name:      "hosts not seen within retention removed",
+			retention: time.Hour,
+			steps: []step{
+				{0, []*inventoryListHost{active("aa", "10.0.0.1"), active("bb", "10.0.0.2"), inactive("cc", "10.0.0.3")}},
+				{2 * time.Hour, []*inventoryListHost{active("aa", "10.0.0.1"), inactive("bb", "10.0.0.2"), inactive("cc", "10.0.0.3")}},
+			},
+			macs:  []string{"aa"},
+			saved: 2 * time.Hour,
+		},
+		{
+			name: "hosts kept without retention",
+			steps: []step{
+				{0, []*inventoryListHost{active("aa", "10.0.0.1"), active("bb", "10.0.0.2"), inactive("cc", "10.0.0.3")}},
+				{2 * time.Hour, []*inventoryListHost{active("aa", "10.0.0.1"), inactive("bb", "10.0.0.2"), inactive("cc", "10.0.0.3")}},
+			},
+			macs:  []string{"aa", "bb", "cc"},
+			saved: 2 * time.Hour,
+		},
+		{
+			name:      "removed host found again is new",
+			retention: time.Hour,
+			steps: []step{
+				{0, []*inventoryListHost{active("aa", "10.0.0.1"), active("bb", "10.0.0.2")}},
+				{2 * time.Hour, []*inventoryListHost{active("aa", "10.0.0.1")}},
+				{3 * time.Hour, []*inventoryListHost{active("aa", "10.0.0.1"), active("bb", "10.0.0.2")}},
+			},
+			macs:       []string{"aa", "bb"},
+			newDevices: 1,
+			saved:      3 * time.Hour,
+		},
+	}
+
+	start := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		inv := newTestInventory(t)
+		for _, s := range tt.steps {
+			if err := inv.update(gateway, s.hosts, start.Add(s.after), tt.retention); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+
+		macs := inventoryMACs(inv, gateway)
+		if len(macs) != len(tt.macs) {
+			t.Errorf("%s: got hosts %v, want %v", tt.name, macs, tt.macs)
+		} else {
+			for i := range macs {
+				if macs[i] != tt.macs[i] {
+					t.Errorf("%s: got hosts %v, want %v", tt.name, macs, tt.macs)
+					break
+				}
+			}
+		}
+
+		if got := inv.newDevices[gateway]; got != tt.newDevices {
+			t.Errorf("%s: got %v new devices, want %v", tt.name, got, tt.newDevices)
+		}
+		if got := inv.saved.Sub(start); got != tt.saved {
+			t.Errorf("%s: last written after %s, want %s", tt.name, got, tt.saved)
+		}
+	}
+}
+
+func TestHostInventoryShared(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "inventory.json")
+	inv, err := openHostInventory(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	hosts := []*inventoryListHost{{MACAddress: "aa", Active: "1"}}
+	other := []*inventoryListHost{{MACAddress: "cc", Active: "1"}}
+	if err = inv.update("box", hosts, now, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = inv.update("repeater", other, now, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// a second collector of the same gateway counts the new host only once
+	same, err := openHostInventory(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same != inv {
+		t.Fatal("got a different inventory for the same file")
+	}
+	hosts = append(hosts, &inventoryListHost{MACAddress: "bb", Active: "1"})
+	for _, i := range []*hostInventory{inv, same} {
+		if err = i.update("box", hosts, now.Add(time.Minute), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if inv.newDevices["box"] != 1 || inv.newDevices["repeater"] != 0 {
+		t.Errorf("got new devices %v, want box 1 and repeater 0", inv.newDevices)
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved hostInventory
+	if err = json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Gateways["box"]) != 2 || len(saved.Gateways["repeater"]) != 1 {
+		t.Errorf("saved %d hosts of box and %d of repeater, want 2 and 1", len(saved.Gateways["box"]), len(saved.Gateways["repeater"]))
+	}
+}
@@ -17,6 +17,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/namsral/flag"
 	"github.com/prometheus/client_golang/prometheus"
@@ -24,7 +25,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"io/ioutil"
 	"net/http"
-	"net/url"
+	"os"
 	"regexp"
 	"sort"
 	"strconv"
@@ -38,6 +39,20 @@ import (
 
 const serviceLoadRetryTime = 1 * time.Minute
 
+// promType for strings with enumerated values, reported as one metric per state with label state (like OpenMetrics
+// state sets)
+const (
+	promTypeStateSet = "StateSet"
+	stateLabel       = "state"
+)
+
+// promType for metrics with constant value 1 reporting strings as labels, the label values are sanitized and
+// truncated to maxInfoLabelLength characters
+const (
+	promTypeInfo       = "Info"
+	maxInfoLabelLength = 128
+)
+
 // minimum TTL for cached results in seconds
 const minCacheTTL = 30
 
@@ -47,11 +62,24 @@ var (
 	flagCollect = flag.Bool("collect", false, "print configured metrics to stdout and exit")
 	flagJSONOut = flag.String("json-out", "", "store metrics also to JSON file when running test")
 
+	flagValidate     = flag.Bool("validate", false, "validate the metric files against the services of the FRITZ!Box and exit")
+	flagServicesFile = flag.String("services-file", "", "validate against services stored in this file instead of loading them from the FRITZ!Box")
+	flagServicesOut  = flag.String("services-out", "", "store the services loaded when running test or validate to this file")
+
 	flagAddr           = flag.String("listen-address", "127.0.0.1:9042", "The address to listen on for HTTP requests.")
+	flagConfigFile     = flag.String("config-file", "", "The JSON file with the targets to collect, replaces the gateway and credential flags.")
 	flagMetricsFile    = flag.String("metrics-file", "metrics.json", "The JSON file with the metric definitions.")
 	flagDisableLua     = flag.Bool("nolua", false, "disable collecting lua metrics")
+	flagPoll           = flag.Bool("poll", false, "refresh metrics in background, scrapes only return the latest results")
+	flagCollectWorkers = flag.Int("collect-workers", 4, "The max. number of concurrent calls to the FRITZ!Box when collecting.")
+	flagCollectors     = flag.String("collectors", "", "Comma separated list of further collectors to enable (calls, homeauto, homeautoswitch, dsl, mesh, inetstat, inventory), wlan is always enabled.")
 	flagLuaMetricsFile = flag.String("lua-metrics-file", "metrics-lua.json", "The JSON file with the lua metric definitions.")
 
+	flagHostInventoryFile      = flag.String("host-inventory-file", "host-inventory.json", "The JSON file the inventory collector stores the hosts seen in.")
+	flagHostInventoryRetention = flag.Duration("host-inventory-retention", 0, "Hosts of the inventory collector not seen for this duration are removed, 0 keeps them forever.")
+	flagProbeHosts             = flag.String("probe-hosts", "", "Comma separated list of further hosts that can be probed using the gateway and credential flags.")
+	flagServicesCacheDir       = flag.String("services-cache-dir", "", "The directory to cache the services of the FRITZ!Box in, collecting starts with them if the FRITZ!Box is not reachable.")
+
 	flagGatewayURL       = flag.String("gateway-url", "http://fritz.box:49000", "The URL of the FRITZ!Box")
 	flagGatewayLuaURL    = flag.String("gateway-luaurl", "http://fritz.box", "The URL of the FRITZ!Box UI")
 	flagUsername         = flag.String("username", "", "The user for the FRITZ!Box UPnP service")
@@ -71,26 +99,6 @@ var (
 		Help: "Number of lua collection errors.",
 	})
 )
-var collectLuaResultsCached = prometheus.NewCounter(prometheus.CounterOpts{
-	Name:        "fritzbox_exporter_results_cached",
-	Help:        "Number of results taken from cache.",
-	ConstLabels: prometheus.Labels{"Cache": "LUA"},
-})
-var collectUpnpResultsCached = prometheus.NewCounter(prometheus.CounterOpts{
-	Name:        "fritzbox_exporter_results_cached",
-	Help:        "Number of results taken from cache.",
-	ConstLabels: prometheus.Labels{"Cache": "UPNP"},
-})
-var collectLuaResultsLoaded = prometheus.NewCounter(prometheus.CounterOpts{
-	Name:        "fritzbox_exporter_results_loaded",
-	Help:        "Number of results loaded from fritzbox.",
-	ConstLabels: prometheus.Labels{"Cache": "LUA"},
-})
-var collectUpnpResultsLoaded = prometheus.NewCounter(prometheus.CounterOpts{
-	Name:        "fritzbox_exporter_results_loaded",
-	Help:        "Number of results loaded from fritzbox.",
-	ConstLabels: prometheus.Labels{"Cache": "UPNP"},
-})
 
 // JSONPromDesc metric description loaded from JSON
 type JSONPromDesc struct {
@@ -109,17 +117,54 @@ type ActionArg struct {
 	Value          string `json:"Value"`
 }
 
+// ActionArgs arguments for upnp action, resolved in order.
+// In JSON a single argument is accepted as well.
+type ActionArgs []*ActionArg
+
+// UnmarshalJSON accepts a list of arguments or a single argument
+func (aa *ActionArgs) UnmarshalJSON(data []byte) error {
+	if data = bytes.TrimSpace(data); len(data) > 0 && data[0] == '{' {
+		var arg ActionArg
+		err := json.Unmarshal(data, &arg)
+		if err != nil {
+			return err
+		}
+
+		*aa = ActionArgs{&arg}
+		return nil
+	}
+
+	return json.Unmarshal(data, (*[]*ActionArg)(aa))
+}
+
+// LabelAction action whose results can be used as labels of a metric
+type LabelAction struct {
+	Service string `json:"service"` // service of the metric if not given
+	Action  string `json:"action"`
+}
+
+// serviceOf returns the service of the label action, which defaults to the service of the metric
+func (la *LabelAction) serviceOf(m *Metric) string {
+	if la.Service == "" {
+		return m.Service
+	}
+	return la.Service
+}
+
 // Metric upnp metric
 type Metric struct {
 	// initialized loading JSON
-	Service        string       `json:"service"`
-	Action         string       `json:"action"`
-	ActionArgument *ActionArg   `json:"actionArgument"`
-	Result         string       `json:"result"`
-	OkValue        string       `json:"okValue"`
-	PromDesc       JSONPromDesc `json:"promDesc"`
-	PromType       string       `json:"promType"`
-	CacheEntryTTL  int64        `json:"cacheEntryTTL"`
+	Service        string          `json:"service"`
+	Action         string          `json:"action"`
+	ActionArgument ActionArgs      `json:"actionArgument"`
+	LabelActions   []*LabelAction  `json:"labelActions"`
+	Result         string          `json:"result"`
+	OkValue        string          `json:"okValue"`
+	Transform      *ValueTransform `json:"transform"`
+	States         []string        `json:"states"`
+	PromDesc       JSONPromDesc    `json:"promDesc"`
+	PromType       string          `json:"promType"`
+	CacheEntryTTL  int64           `json:"cacheEntryTTL"`
 
 	// initialized at startup
 	Desc       *prometheus.Desc
@@ -141,14 +186,16 @@ type LuaLabelRename struct {
 // LuaMetric struct
 type LuaMetric struct {
 	// initialized loading JSON
-	Path          string       `json:"path"`
-	Params        string       `json:"params"`
-	ResultPath    string       `json:"resultPath"`
-	ResultKey     string       `json:"resultKey"`
-	OkValue       string       `json:"okValue"`
-	PromDesc      JSONPromDesc `json:"promDesc"`
-	PromType      string       `json:"promType"`
-	CacheEntryTTL int64        `json:"cacheEntryTTL"`
+	Path          string          `json:"path"`
+	Params        string          `json:"params"`
+	ResultPath    string          `json:"resultPath"`
+	ResultKey     string          `json:"resultKey"`
+	OkValue       string          `json:"okValue"`
+	Transform     *ValueTransform `json:"transform"`
+	States        []string        `json:"states"`
+	PromDesc      JSONPromDesc    `json:"promDesc"`
+	PromType      string          `json:"promType"`
+	CacheEntryTTL int64           `json:"cacheEntryTTL"`
 
 	// initialized at startup
 	Desc         *prometheus.Desc
@@ -163,35 +210,41 @@ type LuaMetricsFile struct {
 	Metrics      []*LuaMetric     `json:"metrics"`
 }
 
-type upnpCacheEntry struct {
-	Timestamp int64
-	Result    *upnp.Result
-}
-
-type luaCacheEntry struct {
-	Timestamp int64
-	Result    *map[string]interface{}
-}
-
-var metrics []*Metric
-var luaMetrics []*LuaMetric
-var upnpCache map[string]*upnpCacheEntry
-var luaCache map[string]*luaCacheEntry
-
 // FritzboxCollector main struct
 type FritzboxCollector struct {
-	URL       string
-	Gateway   string
-	Username  string
-	Password  string
-	VerifyTls bool
+	URL        string
+	Gateway    string
+	Username   string
+	Password   string
+	HTTPClient *http.Client
 
 	// support for lua collector
-	LuaSession   *lua.LuaSession
-	LabelRenames *[]lua.LabelRename
+	LuaSession *lua.LuaSession
+
+	// caches for results, each collector has its own
+	upnpCache *resultCache
+	luaCache  *resultCache
+
+	actions *actionStatus // actions disabled or backing off because of errors
+
+	withUpnp      bool                    // collect upnp metrics
+	withLua       bool                    // collect lua metrics
+	withServices  bool                    // upnp services are needed by the upnp metrics or a sub collector
+	subCollectors map[string]subCollector // collectors of further APIs by name
+	workers       int                     // max. number of concurrent calls to the FRITZ!Box
+	poller        *poller                 // set if metrics are refreshed in background
 
-	sync.Mutex // protects Root
+	hostInventoryFile      string        // file of the inventory collector
+	hostInventoryRetention time.Duration // hosts not seen for this duration are removed from the inventory, 0 keeps them
+	servicesCache          *serviceCache // nil if services are not cached
+
+	sync.Mutex // protects Root and the metric definitions
 	Root       *upnp.Root
+
+	// metric definitions to collect, replaced when reloading
+	Metrics      []*Metric
+	LuaMetrics   []*LuaMetric
+	LabelRenames *[]lua.LabelRename
 }
 
 // simple ResponseWriter to collect output
@@ -217,10 +270,144 @@ func (w *testResponseWriter) String() string {
 	return w.body.String()
 }
 
+// newCollector creates a collector for the target collecting the given collectors
+func newCollector(tc *TargetConfig, collectors []string) *FritzboxCollector {
+	fc := &FritzboxCollector{
+		URL:        tc.GatewayURL,
+		Gateway:    tc.gatewayName(),
+		Username:   tc.username,
+		Password:   tc.password,
+		HTTPClient: tc.client,
+
+		upnpCache: newResultCache(upnpCacheMetrics),
+		luaCache:  newResultCache(luaCacheMetrics),
+		actions:   newActionStatus(),
+
+		subCollectors: make(map[string]subCollector),
+		workers:       tc.CollectWorkers,
+
+		hostInventoryFile:      tc.HostInventoryFile,
+		hostInventoryRetention: tc.hostInventoryRetention,
+	}
+
+	if tc.ServicesCacheDir != "" {
+		fc.servicesCache = &serviceCache{dir: tc.ServicesCacheDir, target: tc.Name}
+	}
+
+	withLuaSession := false
+	for _, c := range collectors {
+		switch c {
+		case collectorUpnp:
+			fc.withUpnp = true
+			fc.withServices = true
+		case collectorLua:
+			fc.withLua = true
+			withLuaSession = true
+		default:
+			def := subCollectorDefs[c]
+			fc.subCollectors[c] = def.create()
+			fc.withServices = fc.withServices || def.services
+			withLuaSession = withLuaSession || def.lua
+		}
+	}
+
+	if withLuaSession {
+		fc.LuaSession = &lua.LuaSession{
+			BaseURL:  tc.GatewayLuaURL,
+			Username: tc.username,
+			Password: tc.password,
+			Client:   tc.client,
+		}
+	}
+
+	fc.setDefinitions(tc.defs)
+
+	if tc.Poll {
+		fc.poller = newPoller()
+		go fc.poll()
+	}
+
+	return fc
+}
+
+// setDefinitions sets the metric definitions for the enabled collectors
+func (fc *FritzboxCollector) setDefinitions(defs *metricDefinitions) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	if fc.withUpnp {
+		fc.Metrics = defs.metrics
+	}
+
+	if fc.withLua {
+		fc.LuaMetrics = defs.luaMetrics
+		fc.LabelRenames = defs.labelRenames
+	}
+}
+
+// loadServices tries once to load the service information
+func (fc *FritzboxCollector) loadServices() error {
+	root, err := upnp.LoadServicesWithClient(fc.URL, fc.Username, fc.Password, fc.HTTPClient)
+	if err != nil {
+		return err
+	}
+
+	fc.setRoot(root)
+
+	if fc.servicesCache != nil {
+		err = fc.servicesCache.save(root)
+		if err != nil {
+			logrus.Warnf("cannot store services in cache: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// loadCachedServices sets the services stored in the cache for the target, returns false if there are none
+func (fc *FritzboxCollector) loadCachedServices() bool {
+	if fc.servicesCache == nil {
+		return false
+	}
+
+	root, err := fc.servicesCache.load(fc)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logrus.Warnf("cannot load services from cache: %s", err)
+		}
+		return false
+	}
+
+	fc.setRoot(root)
+	logrus.Infof("services loaded from cache (%s)", cacheKey(root))
+
+	return true
+}
+
+// setRoot sets the services used for collecting
+func (fc *FritzboxCollector) setRoot(root *upnp.Root) {
+	root.UnknownDataType = func(s *upnp.Service, a *upnp.Action, arg *upnp.Argument) {
+		logrus.Warnf("%s.%s: result %s has unknown data type %s, using value as string", s.ServiceType, a.Name, arg.RelatedStateVariable, arg.StateVariable.DataType)
+		collectErrors.Inc()
+		collectErrorCauses.WithLabelValues(s.ServiceType, a.Name, causeParse).Inc()
+	}
+
+	fc.Lock()
+	fc.Root = root
+	fc.Unlock()
+}
+
 // LoadServices tries to load the service information. Retries until success.
+// If services are cached, collecting starts with them and they are replaced once the FRITZ!Box responds.
 func (fc *FritzboxCollector) LoadServices() {
+	fc.loadCachedServices()
+	fc.refreshServices()
+}
+
+// refreshServices loads the service information from the FRITZ!Box, retries until success
+func (fc *FritzboxCollector) refreshServices() {
 	for {
-		root, err := upnp.LoadServices(fc.URL, fc.Username, fc.Password, fc.VerifyTls)
+		err := fc.loadServices()
 		if err != nil {
 			logrus.Errorf("cannot load services: %s", err)
 
@@ -229,50 +416,84 @@ func (fc *FritzboxCollector) LoadServices() {
 		}
 
 		logrus.Info("services loaded")
-
-		fc.Lock()
-		fc.Root = root
-		fc.Unlock()
 		return
 	}
 }
 
 // Describe describe metric
 func (fc *FritzboxCollector) Describe(ch chan<- *prometheus.Desc) {
+	fc.Lock()
+	metrics := fc.Metrics
+	fc.Unlock()
+
 	for _, m := range metrics {
 		ch <- m.Desc
 	}
 }
 
-func (fc *FritzboxCollector) reportMetric(ch chan<- prometheus.Metric, m *Metric, result upnp.Result, dupCache map[string]bool) {
+// metricResult result of an action call with the results of the provider actions used for its arguments
+type metricResult struct {
+	result upnp.Result
+	labels upnp.Result // provider results, used for labels not contained in result
+}
+
+// label returns the value of the result or provider result
+func (mr *metricResult) label(name string) (interface{}, bool) {
+	if val, ok := mr.result[name]; ok {
+		return val, true
+	}
+
+	val, ok := mr.labels[name]
+	return val, ok
+}
+
+// metricSample value and labels of a metric converted from a result
+type metricSample struct {
+	value  float64
+	labels []string
+}
+
+func (fc *FritzboxCollector) reportMetric(ch chan<- prometheus.Metric, m *Metric, mr *metricResult, dupCache map[string]bool, stats *scrapeStats) {
+	s, ok := fc.metricSample(m, mr, stats)
+	if ok {
+		fc.sendMetric(ch, m, s, dupCache, true)
+	}
+}
+
+// metricSample converts the result to the value and labels of the metric, errors are logged and counted
+func (fc *FritzboxCollector) metricSample(m *Metric, mr *metricResult, stats *scrapeStats) (*metricSample, bool) {
+	val, ok := mr.result[m.Result]
+	if m.PromType == promTypeInfo {
+		// info metrics only report labels
+		val, ok = true, true
+	}
 
-	val, ok := result[m.Result]
 	if !ok {
 		logrus.Debugf("%s.%s has no result %s", m.Service, m.Action, m.Result)
 		collectErrors.Inc()
-		return
+		stats.record(m.Service, m.Action, 0, fmt.Errorf("no result %s", m.Result), causeMissingResult)
+		return nil, false
 	}
 
 	var floatval float64
-	switch tval := val.(type) {
-	case uint64:
-		floatval = float64(tval)
-	case bool:
-		if tval {
-			floatval = 1
-		} else {
-			floatval = 0
+	if m.Transform != nil || m.PromType == promTypeStateSet {
+		var err error
+		floatval, err = m.convert(val)
+		if err != nil {
+			logrus.Warnf("%s.%s result %s: %s", m.Service, m.Action, m.Result, err.Error())
+			collectErrors.Inc()
+			stats.record(m.Service, m.Action, 0, err, "")
+			return nil, false
 		}
-	case string:
-		if tval == m.OkValue {
-			floatval = 1
-		} else {
-			floatval = 0
+	} else {
+		var err error
+		floatval, err = resultValue(val, m.OkValue)
+		if err != nil {
+			logrus.Warnf("%s.%s result %s: %s", m.Service, m.Action, m.Result, err.Error())
+			collectErrors.Inc()
+			stats.record(m.Service, m.Action, 0, err, causeParse)
+			return nil, false
 		}
-	default:
-		logrus.Warnf("unknown type: %s", val)
-		collectErrors.Inc()
-		return
 	}
 
 	labels := make([]string, len(m.PromDesc.VarLabels))
@@ -280,7 +501,7 @@ func (fc *FritzboxCollector) reportMetric(ch chan<- prometheus.Metric, m *Metric
 		if l == "gateway" {
 			labels[i] = fc.Gateway
 		} else {
-			lval, ok := result[l]
+			lval, ok := mr.label(l)
 			if !ok {
 				logrus.Warnf("%s.%s has no resul for label %s", m.Service, m.Action, l)
 				lval = ""
@@ -288,216 +509,530 @@ func (fc *FritzboxCollector) reportMetric(ch chan<- prometheus.Metric, m *Metric
 
 			// convert hostname and MAC tolower to avoid problems with labels
 			if l == "HostName" || l == "MACAddress" {
-				labels[i] = strings.ToLower(fmt.Sprintf("%v", lval))
+				labels[i] = strings.ToLower(formatValue(lval))
 			} else {
-				labels[i] = fmt.Sprintf("%v", lval)
+				labels[i] = formatValue(lval)
+			}
+
+			if m.PromType == promTypeInfo {
+				labels[i] = sanitizeLabelValue(labels[i])
 			}
 		}
 	}
 
+	return &metricSample{value: floatval, labels: labels}, true
+}
+
+// sendMetric sends the sample unless it was reported before in this scrape, duplicates are only counted as errors
+// if countErrors is set, as polled samples are sent on every scrape
+func (fc *FritzboxCollector) sendMetric(ch chan<- prometheus.Metric, m *Metric, s *metricSample, dupCache map[string]bool, countErrors bool) {
 	// check for duplicate labels to prevent collection failure
-	key := m.PromDesc.FqName + ":" + m.PromDesc.fixedLabelValues + strings.Join(labels, ",")
+	key := m.PromDesc.FqName + ":" + m.PromDesc.fixedLabelValues + strings.Join(s.labels, ",")
 	if dupCache[key] {
-		fmt.Printf("%s.%s reported before as: %s\n", m.Service, m.Action, key)
-		collectErrors.Inc()
+		if countErrors {
+			fmt.Printf("%s.%s reported before as: %s\n", m.Service, m.Action, key)
+			collectErrors.Inc()
+		}
 		return
 	}
 	dupCache[key] = true
 
-	metric, err := prometheus.NewConstMetric(m.Desc, m.MetricType, floatval, labels...)
+	metrics, err := newConstMetrics(m.Desc, m.MetricType, s.value, m.States, s.labels)
 	if err != nil {
 		fmt.Printf("Error creating metric %s.%s: %s", m.Service, m.Action, err.Error())
 	} else {
-		ch <- metric
+		for _, metric := range metrics {
+			ch <- metric
+		}
+	}
+}
+
+// convert converts the result using the transform or to the index of the state for state sets
+func (m *Metric) convert(value interface{}) (float64, error) {
+	if m.PromType == promTypeStateSet {
+		return stateIndex(m.States, value)
 	}
+	return m.Transform.apply(value)
 }
 
-func (fc *FritzboxCollector) getActionResult(metric *Metric, actionName string, actionArg *upnp.ActionArgument) (upnp.Result, error) {
+// newConstMetrics creates the metric, for state sets one metric for each state with value 1 for the state with index
+// value and 0 for the others
+func newConstMetrics(desc *prometheus.Desc, valueType prometheus.ValueType, value float64, states []string, labels []string) ([]prometheus.Metric, error) {
+	if states == nil {
+		metric, err := prometheus.NewConstMetric(desc, valueType, value, labels...)
+		if err != nil {
+			return nil, err
+		}
+		return []prometheus.Metric{metric}, nil
+	}
+
+	metrics := make([]prometheus.Metric, len(states))
+	for i, state := range states {
+		stateValue := 0.0
+		if float64(i) == value {
+			stateValue = 1
+		}
+
+		metric, err := prometheus.NewConstMetric(desc, valueType, stateValue, append(labels, state)...)
+		if err != nil {
+			return nil, err
+		}
+		metrics[i] = metric
+	}
 
-	key := metric.Service + "|" + actionName
+	return metrics, nil
+}
+
+// getActionResult gets the action result from cache or calls the action using one of the workers
+func (fc *FritzboxCollector) getActionResult(sc *scrape, serviceType string, actionName string, ttl int64, actionArgs ...*upnp.ActionArgument) (upnp.Result, error) {
+	result, duration, err := fc.loadActionResult(sc, serviceType, actionName, ttl, actionArgs...)
+	fc.recordActionResult(sc, serviceType, actionName, duration, err)
+	return result, err
+}
 
-	// for calls with argument also add argument name and value to key
-	if actionArg != nil {
-		key += "|" + actionArg.Name + "|" + fmt.Sprintf("%v", actionArg.Value)
+// recordActionResult records the duration and error of an action call in the scrape stats
+func (fc *FritzboxCollector) recordActionResult(sc *scrape, serviceType string, actionName string, duration time.Duration, err error) {
+	switch {
+	case errors.Is(err, errActionDisabled):
+		// logged once when disabled
+	case errors.Is(err, errActionSkipped):
+		sc.stats.skip(serviceType, actionName)
+	default:
+		sc.stats.record(serviceType, actionName, duration, err, "")
 	}
+}
 
-	now := time.Now().Unix()
+// loadActionResult gets the action result from cache or calls the action, the duration of the call is 0 if the
+// result was cached
+func (fc *FritzboxCollector) loadActionResult(sc *scrape, serviceType string, actionName string, ttl int64, actionArgs ...*upnp.ActionArgument) (upnp.Result, time.Duration, error) {
 
-	cacheEntry := upnpCache[key]
-	if cacheEntry == nil {
-		cacheEntry = &upnpCacheEntry{}
-		upnpCache[key] = cacheEntry
-	} else if now-cacheEntry.Timestamp > metric.CacheEntryTTL {
-		cacheEntry.Result = nil
+	actionKey := serviceType + "|" + actionName
+	key := actionKey
+
+	// for calls with arguments also add argument names and values to key
+	for _, actionArg := range actionArgs {
+		key += "|" + actionArg.Name + "|" + formatValue(actionArg.Value)
 	}
 
-	if cacheEntry.Result == nil {
-		service, ok := fc.Root.Services[metric.Service]
+	var duration time.Duration // stays 0 if cached
+	result, err := fc.upnpCache.get(key, ttl, func() (interface{}, error) {
+		fc.Lock()
+		root := fc.Root
+		fc.Unlock()
+
+		service, ok := root.Services[serviceType]
 		if !ok {
-			return nil, fmt.Errorf("service %s not found", metric.Service)
+			return nil, fmt.Errorf("service %s not found", serviceType)
 		}
 
 		action, ok := service.Actions[actionName]
 		if !ok {
-			return nil, fmt.Errorf("action %s not found in service %s", actionName, metric.Service)
+			return nil, fmt.Errorf("action %s not found in service %s", actionName, serviceType)
 		}
 
-		data, err := action.Call(actionArg)
-
+		err := fc.actions.check(actionKey, time.Now())
 		if err != nil {
 			return nil, err
 		}
 
-		cacheEntry.Timestamp = now
-		cacheEntry.Result = &data
-		collectUpnpResultsCached.Inc()
-	} else {
-		collectUpnpResultsLoaded.Inc()
+		sc.workers <- struct{}{}
+		defer func() { <-sc.workers }()
+
+		start := time.Now()
+		result, err := action.Call(actionArgs...)
+
+		var sfe *upnp.SoapFaultError
+		if errors.As(err, &sfe) && sfe.Code == upnp.ErrorCodeActionNotAuthorized {
+			// authenticate again, the stored authentication may have lost its rights
+			root.ClearAuth()
+			result, err = action.Call(actionArgs...)
+		}
+
+		duration = time.Since(start)
+		fc.actions.update(actionKey, err, time.Now())
+
+		return result, err
+	})
+
+	if err != nil {
+		return nil, duration, err
 	}
 
-	return *cacheEntry.Result, nil
+	return result.(upnp.Result), duration, nil
 }
 
 // Collect collect upnp metrics
 func (fc *FritzboxCollector) Collect(ch chan<- prometheus.Metric) {
 	fc.Lock()
 	root := fc.Root
+	metrics := fc.Metrics
+	luaMetrics := fc.LuaMetrics
+	labelRenames := fc.LabelRenames
 	fc.Unlock()
 
-	if root == nil {
-		// Services not loaded yet
+	// create cache for duplicate lookup, to prevent collection errors
+	var dupCache = make(map[string]bool)
+
+	sc := &scrape{
+		workers: make(chan struct{}, fc.workers),
+		stats:   newScrapeStats(),
+	}
+
+	if fc.poller != nil {
+		// sub collectors are not polled, their results are cached so the box is called at most once per TTL
+		fc.collectSubCollectors(ch, root, sc)
+		fc.poller.stats.merge(sc.stats)
+
+		fc.collectPolled(ch, metrics, luaMetrics, dupCache)
 		return
 	}
 
-	// create cache for duplicate lookup, to prevent collection errors
-	var dupCache = make(map[string]bool)
+	// upnp metrics can only be collected once services are loaded
+	if root != nil {
+		fc.collectUpnp(ch, metrics, sc, dupCache)
+	}
 
-	for _, m := range metrics {
-		var actArg *upnp.ActionArgument
-		if m.ActionArgument != nil {
-			aa := m.ActionArgument
-			var value interface{}
-			value = aa.Value
-
-			if aa.ProviderAction != "" {
-				provRes, err := fc.getActionResult(m, aa.ProviderAction, nil)
-
-				if err != nil {
-					logrus.Warnf("Error getting provider action %s result for %s.%s: %s", aa.ProviderAction, m.Service, m.Action, err.Error())
-					collectErrors.Inc()
-					continue
-				}
+	// if lua is enabled now also collect metrics
+	if fc.withLua {
+		fc.collectLua(ch, luaMetrics, labelRenames, sc, dupCache)
+	}
 
-				var ok bool
-				value, ok = provRes[aa.Value] // Value contains the result name for provider actions
-				if !ok {
-					logrus.Warnf("provider action %s for %s.%s has no result", m.Service, m.Action, aa.Value)
-					collectErrors.Inc()
-					continue
-				}
-			}
+	fc.collectSubCollectors(ch, root, sc)
+	sc.stats.collect(ch)
+}
 
-			if aa.IsIndex {
-				sval := fmt.Sprintf("%v", value)
-				count, err := strconv.Atoi(sval)
-				if err != nil {
-					fmt.Println(err.Error())
-					collectErrors.Inc()
-					continue
-				}
+// collectSubCollectors collects all sub collectors concurrently, sub collectors needing services are skipped until
+// they are loaded. Duplicates are dropped, so they don't fail the collection.
+func (fc *FritzboxCollector) collectSubCollectors(ch chan<- prometheus.Metric, root *upnp.Root, sc *scrape) {
+	metrics := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		forwardUnique(ch, metrics)
+	}()
+
+	var wg sync.WaitGroup
+	for name, c := range fc.subCollectors {
+		if root == nil && subCollectorDefs[name].services {
+			continue
+		}
 
-				for i := 0; i < count; i++ {
-					actArg = &upnp.ActionArgument{Name: aa.Name, Value: i}
-					result, err := fc.getActionResult(m, m.Action, actArg)
+		wg.Add(1)
+		go func(c subCollector) {
+			defer wg.Done()
+			c.collect(fc, sc, metrics)
+		}(c)
+	}
+	wg.Wait()
 
-					if err != nil {
-						fmt.Println(err.Error())
-						collectErrors.Inc()
-						continue
-					}
+	close(metrics)
+	<-done
+}
 
-					fc.reportMetric(ch, m, result, dupCache)
-				}
+// collectUpnp calls the actions for all metrics concurrently, but reports them in order of the metrics,
+// so duplicates are always detected for the same metric
+func (fc *FritzboxCollector) collectUpnp(ch chan<- prometheus.Metric, metrics []*Metric, sc *scrape, dupCache map[string]bool) {
+	results := make([][]*metricResult, len(metrics))
+
+	var wg sync.WaitGroup
+	for i, m := range metrics {
+		wg.Add(1)
+		go func(i int, m *Metric) {
+			defer wg.Done()
+			results[i], _ = fc.getMetricResults(m, sc)
+		}(i, m)
+	}
+	wg.Wait()
 
-				continue
-			} else {
-				actArg = &upnp.ActionArgument{Name: aa.Name, Value: value}
-			}
+	for i, m := range metrics {
+		for _, result := range results[i] {
+			fc.reportMetric(ch, m, result, dupCache, sc.stats)
 		}
+	}
+}
 
-		result, err := fc.getActionResult(m, m.Action, actArg)
+// getMetricResults gets the results for the metric, one for each combination of index arguments.
+// ok is false if any call failed, the results of the successful calls are returned anyway.
+func (fc *FritzboxCollector) getMetricResults(m *Metric, sc *scrape) (results []*metricResult, ok bool) {
+	return fc.resolveArgs(sc, m, m.ActionArgument, nil, nil)
+}
 
-		if err != nil {
-			logrus.Warnf("can not collect metrics: %s", err)
+// withArg returns a copy of values with arg appended, so values can be shared by concurrent calls
+func withArg(values []*upnp.ActionArgument, arg *upnp.ActionArgument) []*upnp.ActionArgument {
+	res := make([]*upnp.ActionArgument, len(values), len(values)+1)
+	copy(res, values)
+	return append(res, arg)
+}
+
+// withResult returns a copy of labels with the values of result added
+func withResult(labels upnp.Result, result upnp.Result) upnp.Result {
+	res := make(upnp.Result, len(labels)+len(result))
+	for k, v := range labels {
+		res[k] = v
+	}
+	for k, v := range result {
+		res[k] = v
+	}
+	return res
+}
+
+// inputArgs returns the values accepted as input by the action
+func (fc *FritzboxCollector) inputArgs(service string, actionName string, values []*upnp.ActionArgument) []*upnp.ActionArgument {
+	fc.Lock()
+	root := fc.Root
+	fc.Unlock()
+
+	var action *upnp.Action
+	if s, ok := root.Services[service]; ok {
+		action = s.Actions[actionName]
+	}
+
+	res := make([]*upnp.ActionArgument, 0)
+	for _, v := range values {
+		if action == nil {
+			break
+		}
+
+		if arg, ok := action.ArgumentMap[v.Name]; ok && arg.Direction == "in" {
+			res = append(res, v)
+		}
+	}
+
+	return res
+}
+
+// getLabelResults adds the results of the label actions of the metric to labels.
+// Label actions are called with the argument values they accept, if a call fails its labels are empty.
+func (fc *FritzboxCollector) getLabelResults(sc *scrape, m *Metric, values []*upnp.ActionArgument, labels upnp.Result) upnp.Result {
+	for _, la := range m.LabelActions {
+		service := la.serviceOf(m)
+		args := fc.inputArgs(service, la.Action, values)
+		result, err := fc.getActionResult(sc, service, la.Action, m.CacheEntryTTL, args...)
+
+		if errors.Is(err, errActionSkipped) {
+			continue
+		} else if err != nil {
+			logrus.Warnf("Error getting label action %s.%s result for %s.%s: %s", service, la.Action, m.Service, m.Action, err.Error())
 			collectErrors.Inc()
 			continue
 		}
 
-		fc.reportMetric(ch, m, result, dupCache)
+		labels = withResult(labels, result)
 	}
 
-	// if lua is enabled now also collect metrics
-	if fc.LuaSession != nil {
-		fc.collectLua(ch, dupCache)
-	}
+	return labels
 }
 
-func (fc *FritzboxCollector) collectLua(ch chan<- prometheus.Metric, dupCache map[string]bool) {
-	// create a map for caching results
-	now := time.Now().Unix()
+// resolveArgs resolves the first of args and continues with the others, the action is called once all are resolved.
+// For index arguments this is done concurrently for all indexes, results are returned in order of the indexes.
+// Provider actions are called with the values resolved before which they accept, so an outer index can be used to
+// get the count of an inner index. The provider results are kept in labels.
+func (fc *FritzboxCollector) resolveArgs(sc *scrape, m *Metric, args ActionArgs, values []*upnp.ActionArgument, labels upnp.Result) ([]*metricResult, bool) {
+	if len(args) == 0 {
+		result, err := fc.getActionResult(sc, m.Service, m.Action, m.CacheEntryTTL, values...)
+
+		if errors.Is(err, errActionSkipped) {
+			return nil, false
+		} else if err != nil {
+			logrus.Warnf("can not collect metrics: %s", err)
+			collectErrors.Inc()
+			return nil, false
+		}
 
-	for _, lm := range luaMetrics {
-		key := lm.Path + "_" + lm.Params
+		return []*metricResult{{result: result, labels: fc.getLabelResults(sc, m, values, labels)}}, true
+	}
 
-		cacheEntry := luaCache[key]
-		if cacheEntry == nil {
-			cacheEntry = &luaCacheEntry{}
-			luaCache[key] = cacheEntry
-		} else if now-cacheEntry.Timestamp > lm.CacheEntryTTL {
-			cacheEntry.Result = nil
+	aa := args[0]
+	var value interface{}
+	value = aa.Value
+
+	if aa.ProviderAction != "" {
+		provArgs := fc.inputArgs(m.Service, aa.ProviderAction, values)
+		provRes, err := fc.getActionResult(sc, m.Service, aa.ProviderAction, m.CacheEntryTTL, provArgs...)
+
+		if errors.Is(err, errActionSkipped) {
+			return nil, false
+		} else if err != nil {
+			logrus.Warnf("Error getting provider action %s result for %s.%s: %s", aa.ProviderAction, m.Service, m.Action, err.Error())
+			collectErrors.Inc()
+			return nil, false
 		}
 
-		if cacheEntry.Result == nil {
-			pageData, err := fc.LuaSession.LoadData(lm.LuaPage)
+		var ok bool
+		value, ok = provRes[aa.Value] // Value contains the result name for provider actions
+		if !ok {
+			logrus.Warnf("provider action %s for %s.%s has no result %s", aa.ProviderAction, m.Service, m.Action, aa.Value)
+			collectErrors.Inc()
+			sc.stats.record(m.Service, aa.ProviderAction, 0, fmt.Errorf("no result %s", aa.Value), causeMissingResult)
+			return nil, false
+		}
 
-			if err != nil {
-				fmt.Printf("Error loading %s for %s.%s: %s\n", lm.Path, lm.ResultPath, lm.ResultKey, err.Error())
-				luaCollectErrors.Inc()
-				fc.LuaSession.SID = "" // clear SID in case of error, so force reauthentication
-				continue
-			}
+		labels = withResult(labels, provRes)
+	}
 
-			var data map[string]interface{}
-			data, err = lua.ParseJSON(pageData)
-			if err != nil {
-				fmt.Printf("Error parsing JSON from %s for %s.%s: %s\n", lm.Path, lm.ResultPath, lm.ResultKey, err.Error())
-				luaCollectErrors.Inc()
-				continue
-			}
+	if !aa.IsIndex {
+		return fc.resolveArgs(sc, m, args[1:], withArg(values, &upnp.ActionArgument{Name: aa.Name, Value: value}), labels)
+	}
 
-			cacheEntry.Result = &data
-			cacheEntry.Timestamp = now
-			collectLuaResultsLoaded.Inc()
-		} else {
-			collectLuaResultsCached.Inc()
+	sval := fmt.Sprintf("%v", value)
+	count, err := strconv.Atoi(sval)
+	if err != nil {
+		fmt.Println(err.Error())
+		collectErrors.Inc()
+		sc.stats.record(m.Service, aa.ProviderAction, 0, err, causeParse)
+		return nil, false
+	}
+
+	indexResults := make([][]*metricResult, count)
+	indexOk := make([]bool, count)
+
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			actArg := &upnp.ActionArgument{Name: aa.Name, Value: i}
+			indexResults[i], indexOk[i] = fc.resolveArgs(sc, m, args[1:], withArg(values, actArg), labels)
+		}(i)
+	}
+	wg.Wait()
+
+	results := make([]*metricResult, 0, count)
+	ok := true
+	for i := range indexResults {
+		results = append(results, indexResults[i]...)
+		ok = ok && indexOk[i]
+	}
+
+	return results, ok
+}
+
+// collectLua loads the pages for all metrics concurrently, but reports them in order of the metrics
+func (fc *FritzboxCollector) collectLua(ch chan<- prometheus.Metric, luaMetrics []*LuaMetric, labelRenames *[]lua.LabelRename, sc *scrape, dupCache map[string]bool) {
+	values := make([][]lua.LuaMetricValue, len(luaMetrics))
+
+	var wg sync.WaitGroup
+	for i, lm := range luaMetrics {
+		wg.Add(1)
+		go func(i int, lm *LuaMetric) {
+			defer wg.Done()
+			values[i] = fc.getLuaMetricValues(lm, labelRenames, sc)
+		}(i, lm)
+	}
+	wg.Wait()
+
+	for i, lm := range luaMetrics {
+		for _, mv := range values[i] {
+			fc.reportLuaMetric(ch, lm, mv, dupCache, true)
 		}
+	}
+}
 
-		metricVals, err := lua.GetMetrics(fc.LabelRenames, *cacheEntry.Result, lm.LuaMetricDef)
+// getLuaPage gets the parsed page from cache or loads it using one of the workers
+func (fc *FritzboxCollector) getLuaPage(lm *LuaMetric, sc *scrape) (map[string]interface{}, error) {
+	var duration time.Duration // stays 0 if cached
+	data, err := fc.luaCache.get(lm.cacheKey(), lm.CacheEntryTTL, func() (interface{}, error) {
+		sc.workers <- struct{}{}
+		start := time.Now()
+		pageData, err := fc.LuaSession.LoadData(lm.LuaPage)
+		duration = time.Since(start)
+		<-sc.workers
 
 		if err != nil {
-			fmt.Printf("Error getting metric values for %s.%s: %s\n", lm.ResultPath, lm.ResultKey, err.Error())
-			luaCollectErrors.Inc()
-			cacheEntry.Result = nil // don't use invalid results for cache
-			continue
+			fc.LuaSession.ClearSID() // clear SID in case of error, so force reauthentication
+			return nil, fmt.Errorf("Error loading %s for %s.%s: %w", lm.Path, lm.ResultPath, lm.ResultKey, err)
+		}
+
+		data, err := lua.ParseJSON(pageData)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing JSON from %s for %s.%s: %w", lm.Path, lm.ResultPath, lm.ResultKey, err)
 		}
 
-		for _, mv := range metricVals {
-			fc.reportLuaMetric(ch, lm, mv, dupCache)
+		return data, nil
+	})
+
+	sc.stats.record(luaService, lm.page(), duration, err, "")
+	if err != nil {
+		return nil, err
+	}
+
+	m, ok := data.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected type %T of %s in cache for %s.%s", data, lm.Path, lm.ResultPath, lm.ResultKey)
+	}
+	return m, nil
+}
+
+// cacheKey key of the lua page in cache
+func (lm *LuaMetric) cacheKey() string {
+	return luaPageCacheKey(lm.LuaPage, luaParserJSON)
+}
+
+// page path and params of the lua page
+func (lm *LuaMetric) page() string {
+	if lm.Params == "" {
+		return lm.Path
+	}
+	return lm.Path + "?" + lm.Params
+}
+
+func (fc *FritzboxCollector) getLuaMetricValues(lm *LuaMetric, labelRenames *[]lua.LabelRename, sc *scrape) []lua.LuaMetricValue {
+	data, err := fc.getLuaPage(lm, sc)
+	if err != nil {
+		fmt.Println(err.Error())
+		luaCollectErrors.Inc()
+		return nil
+	}
+
+	metricDef := lm.LuaMetricDef
+	if lm.PromType == promTypeInfo {
+		// info metrics only report labels, so any value is fine
+		metricDef.Convert = func(value interface{}) (float64, error) {
+			return 1, nil
+		}
+	} else if lm.Transform != nil || lm.PromType == promTypeStateSet {
+		// values that can't be converted are skipped and counted as errors
+		metricDef.Convert = func(value interface{}) (float64, error) {
+			fval, err := lm.convert(value)
+			if err != nil {
+				fmt.Printf("Error transforming value of %s.%s: %s\n", lm.ResultPath, lm.ResultKey, err.Error())
+				luaCollectErrors.Inc()
+				sc.stats.record(luaService, lm.page(), 0, err, "")
+			}
+			return fval, err
 		}
 	}
+
+	metricVals, err := lua.GetMetrics(labelRenames, data, metricDef)
+
+	if errors.Is(err, errTransform) {
+		// already counted
+		return nil
+	} else if err != nil {
+		fmt.Printf("Error getting metric values for %s.%s: %s\n", lm.ResultPath, lm.ResultKey, err.Error())
+		luaCollectErrors.Inc()
+		sc.stats.record(luaService, lm.page(), 0, err, causeMissingResult)
+
+		// don't use invalid results for cache
+		fc.luaCache.remove(lm.cacheKey())
+		return nil
+	}
+
+	return metricVals
+}
+
+// convert converts the value using the transform or to the index of the state for state sets
+func (lm *LuaMetric) convert(value interface{}) (float64, error) {
+	if lm.PromType == promTypeStateSet {
+		return stateIndex(lm.States, value)
+	}
+	return lm.Transform.apply(value)
 }
 
-func (fc *FritzboxCollector) reportLuaMetric(ch chan<- prometheus.Metric, lm *LuaMetric, value lua.LuaMetricValue, dupCache map[string]bool) {
+// reportLuaMetric sends the value unless it was reported before in this scrape, duplicates are only counted as errors
+// if countErrors is set, as polled values are sent on every scrape
+func (fc *FritzboxCollector) reportLuaMetric(ch chan<- prometheus.Metric, lm *LuaMetric, value lua.LuaMetricValue, dupCache map[string]bool, countErrors bool) {
 
 	labels := make([]string, len(lm.PromDesc.VarLabels))
 	for i, l := range lm.PromDesc.VarLabels {
@@ -516,23 +1051,31 @@ func (fc *FritzboxCollector) reportLuaMetric(ch chan<- prometheus.Metric, lm *Lu
 			} else {
 				labels[i] = fmt.Sprintf("%v", lval)
 			}
+
+			if lm.PromType == promTypeInfo {
+				labels[i] = sanitizeLabelValue(labels[i])
+			}
 		}
 	}
 
 	// check for duplicate labels to prevent collection failure
 	key := lm.PromDesc.FqName + ":" + lm.PromDesc.fixedLabelValues + strings.Join(labels, ",")
 	if dupCache[key] {
-		fmt.Printf("%s.%s reported before as: %s\n", lm.ResultPath, lm.ResultPath, key)
-		luaCollectErrors.Inc()
+		if countErrors {
+			fmt.Printf("%s.%s reported before as: %s\n", lm.ResultPath, lm.ResultPath, key)
+			luaCollectErrors.Inc()
+		}
 		return
 	}
 	dupCache[key] = true
 
-	metric, err := prometheus.NewConstMetric(lm.Desc, lm.MetricType, value.Value, labels...)
+	metrics, err := newConstMetrics(lm.Desc, lm.MetricType, value.Value, lm.States, labels)
 	if err != nil {
 		fmt.Printf("Error creating metric %s.%s: %s", lm.ResultPath, lm.ResultPath, err.Error())
 	} else {
-		ch <- metric
+		for _, metric := range metrics {
+			ch <- metric
+		}
 	}
 }
 
@@ -542,6 +1085,13 @@ func test() {
 		panic(err)
 	}
 
+	if *flagServicesOut != "" {
+		err = root.SaveServices(*flagServicesOut)
+		if err != nil {
+			logrus.Warnf("Failed writing services file '%s': %s", *flagServicesOut, err.Error())
+		}
+	}
+
 	var newEntry = false
 	var json bytes.Buffer
 	json.WriteString("[\n")
@@ -651,166 +1201,280 @@ func testLua() {
 	}
 }
 
-func getValueType(vt string) prometheus.ValueType {
-	switch vt {
-	case "CounterValue":
-		return prometheus.CounterValue
-	case "GaugeValue":
-		return prometheus.GaugeValue
-	case "UntypedValue":
-		return prometheus.UntypedValue
+// loadMetrics reads the upnp metric definitions and initializes them
+func loadMetrics(file string) ([]*Metric, error) {
+	jsonData, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading metric file: %s", err.Error())
 	}
 
-	return prometheus.UntypedValue
-}
+	var metrics []*Metric
+	err = json.Unmarshal(jsonData, &metrics)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing JSON: %s", err.Error())
+	}
 
-func main() {
-	flag.Parse()
+	// init metrics
+	for _, m := range metrics {
+		pd := &m.PromDesc
+		labels := descLabels(pd, m.PromType)
 
-	u, err := url.Parse(*flagGatewayURL)
-	if err != nil {
-		logrus.Errorf("invalid URL:", err)
-		return
+		// create fixed labels values
+		pd.fixedLabelValues = ""
+		for _, flv := range pd.FixedLabels {
+			pd.fixedLabelValues += flv + ","
+		}
+
+		m.Desc = prometheus.NewDesc(pd.FqName, pd.Help, labels, pd.FixedLabels)
+		m.MetricType = getValueType(m.PromType)
+
+		err = checkValueOptions(m.PromType, m.States, m.Transform, m.OkValue)
+		if err != nil {
+			return nil, fmt.Errorf("error in %s.%s: %s", m.Service, m.Action, err.Error())
+		}
+
+		if m.Transform != nil {
+			err = m.Transform.init()
+			if err != nil {
+				return nil, fmt.Errorf("error in transform of %s.%s: %s", m.Service, m.Action, err.Error())
+			}
+		}
+
+		// init TTL
+		if m.CacheEntryTTL < minCacheTTL {
+			m.CacheEntryTTL = minCacheTTL
+		}
 	}
 
-	if *flagTest {
-		test()
-		return
+	descs := make([]*prometheus.Desc, len(metrics))
+	for i, m := range metrics {
+		descs[i] = m.Desc
 	}
 
-	if *flagLuaTest {
-		testLua()
-		return
+	err = checkDescs(descs)
+	if err != nil {
+		return nil, err
 	}
 
-	// read metrics
-	jsonData, err := ioutil.ReadFile(*flagMetricsFile)
+	return metrics, nil
+}
+
+// loadLuaMetrics reads the lua metric definitions and label renames and initializes them
+func loadLuaMetrics(file string) ([]*LuaMetric, *[]lua.LabelRename, error) {
+	jsonData, err := ioutil.ReadFile(file)
 	if err != nil {
-		logrus.Errorf("error reading metric file:", err)
-		return
+		return nil, nil, fmt.Errorf("error reading lua metric file: %s", err.Error())
 	}
 
-	err = json.Unmarshal(jsonData, &metrics)
+	var lmf *LuaMetricsFile
+	err = json.Unmarshal(jsonData, &lmf)
 	if err != nil {
-		logrus.Errorf("error parsing JSON:", err)
-		return
+		return nil, nil, fmt.Errorf("error parsing lua JSON: %s", err.Error())
 	}
 
-	// create a map for caching results
-	upnpCache = make(map[string]*upnpCacheEntry)
+	// init label renames
+	lblRen := make([]lua.LabelRename, 0)
+	for _, ren := range lmf.LabelRenames {
+		regex, err := regexp.Compile(ren.MatchRegex)
 
-	var luaSession *lua.LuaSession
-	var luaLabelRenames *[]lua.LabelRename
-	if !*flagDisableLua {
-		jsonData, err := ioutil.ReadFile(*flagLuaMetricsFile)
 		if err != nil {
-			fmt.Println("error reading lua metric file:", err)
-			return
+			return nil, nil, fmt.Errorf("error compiling lua rename regex: %s", err.Error())
+		}
+
+		lblRen = append(lblRen, lua.LabelRename{Pattern: *regex, Name: ren.RenameLabel})
+	}
+
+	// init metrics
+	for _, lm := range lmf.Metrics {
+		pd := &lm.PromDesc
+		labels := descLabels(pd, lm.PromType)
+
+		// create fixed labels values
+		pd.fixedLabelValues = ""
+		for _, flv := range pd.FixedLabels {
+			pd.fixedLabelValues += flv + ","
 		}
 
-		var lmf *LuaMetricsFile
-		err = json.Unmarshal(jsonData, &lmf)
+		lm.Desc = prometheus.NewDesc(pd.FqName, pd.Help, labels, pd.FixedLabels)
+		lm.MetricType = getValueType(lm.PromType)
+
+		err = checkValueOptions(lm.PromType, lm.States, lm.Transform, lm.OkValue)
 		if err != nil {
-			fmt.Println("error parsing lua JSON:", err)
-			return
+			return nil, nil, fmt.Errorf("error in %s.%s: %s", lm.ResultPath, lm.ResultKey, err.Error())
 		}
 
-		// create a map for caching results
-		luaCache = make(map[string]*luaCacheEntry)
+		lm.LuaPage = lua.LuaPage{
+			Path:   lm.Path,
+			Params: lm.Params,
+		}
 
-		// init label renames
-		lblRen := make([]lua.LabelRename, 0)
-		for _, ren := range lmf.LabelRenames {
-			regex, err := regexp.Compile(ren.MatchRegex)
+		lm.LuaMetricDef = lua.LuaMetricValueDefinition{
+			Path:    lm.ResultPath,
+			Key:     lm.ResultKey,
+			OkValue: lm.OkValue,
+			Labels:  pd.VarLabels,
+		}
 
+		if lm.Transform != nil {
+			err = lm.Transform.init()
 			if err != nil {
-				fmt.Println("error compiling lua rename regex:", err)
-				return
+				return nil, nil, fmt.Errorf("error in transform of %s.%s: %s", lm.ResultPath, lm.ResultKey, err.Error())
 			}
+		}
 
-			lblRen = append(lblRen, lua.LabelRename{Pattern: *regex, Name: ren.RenameLabel})
+		// init TTL
+		if lm.CacheEntryTTL < minCacheTTL {
+			lm.CacheEntryTTL = minCacheTTL
 		}
-		luaLabelRenames = &lblRen
+	}
+
+	descs := make([]*prometheus.Desc, len(lmf.Metrics))
+	for i, lm := range lmf.Metrics {
+		descs[i] = lm.Desc
+	}
 
-		// init metrics
-		luaMetrics = lmf.Metrics
-		for _, lm := range luaMetrics {
-			pd := &lm.PromDesc
+	err = checkDescs(descs)
+	if err != nil {
+		return nil, nil, err
+	}
 
-			// make labels lower case
-			labels := make([]string, len(pd.VarLabels))
-			for i, l := range pd.VarLabels {
-				labels[i] = strings.ToLower(l)
-			}
+	return lmf.Metrics, &lblRen, nil
+}
 
-			// create fixed labels values
-			pd.fixedLabelValues = ""
-			for _, flv := range pd.FixedLabels {
-				pd.fixedLabelValues += flv + ","
-			}
+// descCollector only describes, used to check descriptors
+type descCollector []*prometheus.Desc
 
-			lm.Desc = prometheus.NewDesc(pd.FqName, pd.Help, labels, pd.FixedLabels)
-			lm.MetricType = getValueType(lm.PromType)
+func (dc descCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range dc {
+		ch <- d
+	}
+}
 
-			lm.LuaPage = lua.LuaPage{
-				Path:   lm.Path,
-				Params: lm.Params,
-			}
+func (dc descCollector) Collect(ch chan<- prometheus.Metric) {
+}
 
-			lm.LuaMetricDef = lua.LuaMetricValueDefinition{
-				Path:    lm.ResultPath,
-				Key:     lm.ResultKey,
-				OkValue: lm.OkValue,
-				Labels:  pd.VarLabels,
-			}
+// checkDescs checks if the descriptors are valid and consistent by registering them
+func checkDescs(descs []*prometheus.Desc) error {
+	if len(descs) == 0 {
+		return nil
+	}
 
-			// init TTL
-			if lm.CacheEntryTTL < minCacheTTL {
-				lm.CacheEntryTTL = minCacheTTL
-			}
-		}
+	return prometheus.NewRegistry().Register(descCollector(descs))
+}
 
-		luaSession = &lua.LuaSession{
-			BaseURL:  *flagGatewayLuaURL,
-			Username: *flagUsername,
-			Password: *flagPassword,
-		}
+// descLabels returns the variable labels of the descriptor in lower case, state sets have the additional label state
+func descLabels(pd *JSONPromDesc, promType string) []string {
+	labels := make([]string, len(pd.VarLabels), len(pd.VarLabels)+1)
+	for i, l := range pd.VarLabels {
+		labels[i] = strings.ToLower(l)
 	}
 
-	// init metrics
-	for _, m := range metrics {
-		pd := &m.PromDesc
+	if promType == promTypeStateSet {
+		labels = append(labels, stateLabel)
+	}
+
+	return labels
+}
+
+// checkValueOptions checks that states are given exactly for state sets, state sets and info metrics use neither
+// transform nor okValue
+func checkValueOptions(promType string, states []string, t *ValueTransform, okValue string) error {
+	if promType == promTypeInfo && (t != nil || okValue != "") {
+		return fmt.Errorf("promType %s can't be combined with transform or okValue", promTypeInfo)
+	}
 
-		// make labels lower case
-		labels := make([]string, len(pd.VarLabels))
-		for i, l := range pd.VarLabels {
-			labels[i] = strings.ToLower(l)
+	if promType != promTypeStateSet {
+		if states != nil {
+			return fmt.Errorf("states are only used for promType %s", promTypeStateSet)
 		}
+		return nil
+	}
 
-		// create fixed labels values
-		pd.fixedLabelValues = ""
-		for _, flv := range pd.FixedLabels {
-			pd.fixedLabelValues += flv + ","
+	if len(states) == 0 {
+		return fmt.Errorf("promType %s needs states", promTypeStateSet)
+	}
+
+	if t != nil || okValue != "" {
+		return fmt.Errorf("promType %s can't be combined with transform or okValue", promTypeStateSet)
+	}
+
+	seen := make(map[string]bool)
+	for _, state := range states {
+		if seen[state] {
+			return fmt.Errorf("state %s is listed twice", state)
 		}
+		seen[state] = true
+	}
 
-		m.Desc = prometheus.NewDesc(pd.FqName, pd.Help, labels, pd.FixedLabels)
-		m.MetricType = getValueType(m.PromType)
+	return nil
+}
 
-		// init TTL
-		if m.CacheEntryTTL < minCacheTTL {
-			m.CacheEntryTTL = minCacheTTL
+func getValueType(vt string) prometheus.ValueType {
+	switch vt {
+	case promTypeStateSet, promTypeInfo:
+		return prometheus.GaugeValue
+	case "CounterValue":
+		return prometheus.CounterValue
+	case "GaugeValue":
+		return prometheus.GaugeValue
+	case "UntypedValue":
+		return prometheus.UntypedValue
+	}
+
+	return prometheus.UntypedValue
+}
+
+func main() {
+	flag.Parse()
+
+	if *flagTest {
+		test()
+		return
+	}
+
+	if *flagLuaTest {
+		testLua()
+		return
+	}
+
+	var targets []*TargetConfig
+	var err error
+	if *flagConfigFile != "" {
+		targets, err = loadConfig(*flagConfigFile)
+	} else {
+		var tc *TargetConfig
+		tc, err = flagTarget()
+		targets = []*TargetConfig{tc}
+	}
+
+	if err != nil {
+		logConfigError(err)
+		return
+	}
+
+	if *flagValidate {
+		if !validateMetrics(targets) {
+			os.Exit(1)
 		}
+		return
 	}
 
-	collector := &FritzboxCollector{
-		URL:       *flagGatewayURL,
-		Gateway:   u.Hostname(),
-		Username:  *flagUsername,
-		Password:  *flagPassword,
-		VerifyTls: *flagGatewayVerifyTLS,
+	err = loadTargetDefinitions(targets)
+	if err != nil {
+		logConfigError(err)
+		return
+	}
 
-		LuaSession:   luaSession,
-		LabelRenames: luaLabelRenames,
+	// the first target is collected on /metrics, all targets are available on /probe
+	target := targets[0]
+	if *flagCollect {
+		target.Poll = false // collect once directly
+	}
+	probeTargets.init(targets, *flagConfigFile != "", splitList(*flagProbeHosts))
+	collector, err := probeTargets.get(target.Name, moduleDefault)
+	if err != nil {
+		logrus.Errorf("error creating collector: %s", err)
+		return
 	}
 
 	if *flagCollect {
@@ -818,7 +1482,8 @@ func main() {
 
 		prometheus.MustRegister(collector)
 		prometheus.MustRegister(collectErrors)
-		if luaSession != nil {
+		prometheus.MustRegister(collectErrorCauses)
+		if collector.LuaSession != nil {
 			prometheus.MustRegister(luaCollectErrors)
 		}
 
@@ -835,22 +1500,34 @@ func main() {
 	}
 
 	go collector.LoadServices()
+	handleReloadSignal()
 
 	prometheus.MustRegister(collector)
 	prometheus.MustRegister(collectErrors)
-	prometheus.MustRegister(collectUpnpResultsCached)
-	prometheus.MustRegister(collectUpnpResultsLoaded)
+	prometheus.MustRegister(collectErrorCauses)
+	prometheus.MustRegister(configReloadSuccess)
+	prometheus.MustRegister(configReloadSeconds)
+
+	// initial load counts as successful reload
+	configReloadSuccess.Set(1)
+	configReloadSeconds.SetToCurrentTime()
+	upnpCacheMetrics.register()
 
-	if luaSession != nil {
+	if collector.LuaSession != nil {
 		prometheus.MustRegister(luaCollectErrors)
-		prometheus.MustRegister(collectLuaResultsCached)
-		prometheus.MustRegister(collectLuaResultsLoaded)
+		luaCacheMetrics.register()
 	}
 
-	healthChecks := createHealthChecks(*flagGatewayURL)
+	healthChecks := createHealthChecks(target.GatewayURL)
 
 	http.Handle("/metrics", promhttp.Handler())
 	logrus.Infof("metrics available at http://%s/metrics", *flagAddr)
+	http.HandleFunc("/probe", probeHandler)
+	logrus.Infof("probe endpoint for further targets available at http://%s/probe?target=<target>&module=<module>", *flagAddr)
+	http.HandleFunc("/homeautoswitch/stats", homeautoStatsHandler)
+	logrus.Infof("stored values of smart home devices available at http://%s/homeautoswitch/stats?target=<target>", *flagAddr)
+	http.HandleFunc("/-/reload", reloadHandler)
+	logrus.Infof("metric definitions can be reloaded by POST to http://%s/-/reload or SIGHUP", *flagAddr)
 	http.HandleFunc("/ready", healthChecks.ReadyEndpoint)
 	logrus.Infof("readyness check available at http://%s/ready\n", *flagAddr)
 	http.HandleFunc("/live", healthChecks.LiveEndpoint)
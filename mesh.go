@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	meshService = "urn:dslforum-org:service:Hosts:1"
+	meshAction  = "X_AVM-DE_GetMeshListPath"
+
+	// TTL of the mesh list, the box updates the rates every few seconds
+	meshTTL = minCacheTTL
+)
+
+var meshLinkLabels = []string{"gateway", "node", "interface", "peer", "peer_interface", "peer_mac", "type"}
+
+var (
+	meshNodeInfoDesc = prometheus.NewDesc(
+		"gateway_mesh_node_info",
+		"Node of the mesh with its role, model and firmware, value is always 1.",
+		[]string{"gateway", "node", "mac", "role", "model", "firmware"},
+		nil,
+	)
+	meshNodeMeshedDesc = prometheus.NewDesc(
+		"gateway_mesh_node_meshed",
+		"Whether the node is part of the mesh (master or repeater).",
+		[]string{"gateway", "node", "mac"},
+		nil,
+	)
+	meshLinkUpDesc = prometheus.NewDesc(
+		"gateway_mesh_link_up",
+		"Whether the link between the node and its peer is connected.",
+		meshLinkLabels,
+		nil,
+	)
+	meshLinkRateDesc = prometheus.NewDesc(
+		"gateway_mesh_link_rate_bytes_per_second",
+		"Current data rate of the link by direction as seen from the node.",
+		append(meshLinkLabels, "direction"),
+		nil,
+	)
+	meshLinkMaxRateDesc = prometheus.NewDesc(
+		"gateway_mesh_link_max_rate_bytes_per_second",
+		"Maximum data rate of the link by direction as seen from the node.",
+		append(meshLinkLabels, "direction"),
+		nil,
+	)
+)
+
+// meshList JSON returned by the URL of X_AVM-DE_GetMeshListPath
+type meshList struct {
+	SchemaVersion string      `json:"schema_version"`
+	Nodes         []*meshNode `json:"nodes"`
+}
+
+type meshNode struct {
+	UID             string           `json:"uid"`
+	Name            string           `json:"device_name"`
+	MACAddress      string           `json:"device_mac_address"`
+	Model           string           `json:"device_model"`
+	FirmwareVersion string           `json:"device_firmware_version"`
+	Meshed          bool             `json:"is_meshed"`
+	Role            string           `json:"mesh_role"` // master, slave or unknown
+	Interfaces      []*meshInterface `json:"node_interfaces"`
+}
+
+type meshInterface struct {
+	UID        string      `json:"uid"`
+	Name       string      `json:"name"`
+	Type       string      `json:"type"` // LAN, WLAN or PLC
+	MACAddress string      `json:"mac_address"`
+	Links      []*meshLink `json:"node_links"`
+}
+
+// meshLink link between two interfaces, listed at the interfaces of both nodes
+type meshLink struct {
+	UID           string  `json:"uid"`
+	Type          string  `json:"type"`
+	State         string  `json:"state"` // CONNECTED or DISCONNECTED
+	Node1UID      string  `json:"node_1_uid"`
+	Node2UID      string  `json:"node_2_uid"`
+	Interface1UID string  `json:"node_interface_1_uid"`
+	Interface2UID string  `json:"node_interface_2_uid"`
+	MaxRateRX     float64 `json:"max_data_rate_rx"` // kbit/s
+	MaxRateTX     float64 `json:"max_data_rate_tx"` // kbit/s
+	CurRateRX     float64 `json:"cur_data_rate_rx"` // kbit/s
+	CurRateTX     float64 `json:"cur_data_rate_tx"` // kbit/s
+}
+
+// meshCollector reports the nodes and links of the mesh
+type meshCollector struct{}
+
+func newMeshCollector() subCollector {
+	return &meshCollector{}
+}
+
+func (mc *meshCollector) collect(fc *FritzboxCollector, sc *scrape, ch chan<- prometheus.Metric) {
+	doc, err := fc.getDocument(sc, meshService, meshAction, "X_AVM-DE_MeshListPath", meshTTL)
+	if err != nil {
+		logCollectError("mesh list", err)
+		return
+	}
+
+	var list meshList
+	err = json.Unmarshal(doc, &list)
+	if err != nil {
+		err = fmt.Errorf("error parsing mesh list: %w", err)
+		sc.stats.record(meshService, meshAction, 0, err, causeParse)
+		logCollectError("mesh list", err)
+		return
+	}
+
+	nodes := make(map[string]*meshNode, len(list.Nodes))
+	interfaces := make(map[string]*meshInterface)
+	for _, node := range list.Nodes {
+		nodes[node.UID] = node
+		for _, ni := range node.Interfaces {
+			interfaces[ni.UID] = ni
+		}
+	}
+
+	links := make(map[string]bool)
+	for _, node := range list.Nodes {
+		mac := strings.ToLower(node.MACAddress)
+		name := sanitizeLabelValue(node.Name)
+
+		ch <- prometheus.MustNewConstMetric(meshNodeInfoDesc, prometheus.GaugeValue, 1, fc.Gateway, name, mac,
+			node.Role, sanitizeLabelValue(node.Model), sanitizeLabelValue(node.FirmwareVersion))
+
+		meshed := 0.0
+		if node.Meshed {
+			meshed = 1
+		}
+		ch <- prometheus.MustNewConstMetric(meshNodeMeshedDesc, prometheus.GaugeValue, meshed, fc.Gateway, name, mac)
+
+		for _, ni := range node.Interfaces {
+			for _, link := range ni.Links {
+				// each link is listed by both nodes
+				if links[link.UID] {
+					continue
+				}
+				links[link.UID] = true
+
+				reportMeshLink(fc.Gateway, link, nodes, interfaces, ch)
+			}
+		}
+	}
+}
+
+// reportMeshLink reports the link from node 1, which is the access point or the node closer to the master
+func reportMeshLink(gateway string, link *meshLink, nodes map[string]*meshNode, interfaces map[string]*meshInterface, ch chan<- prometheus.Metric) {
+	node, peer := nodes[link.Node1UID], nodes[link.Node2UID]
+	if node == nil || peer == nil {
+		logCollectError("mesh link "+link.UID, fmt.Errorf("unknown node %s or %s", link.Node1UID, link.Node2UID))
+		return
+	}
+
+	labels := []string{gateway, sanitizeLabelValue(node.Name), meshInterfaceName(interfaces[link.Interface1UID]),
+		sanitizeLabelValue(peer.Name), meshInterfaceName(interfaces[link.Interface2UID]), strings.ToLower(peer.MACAddress), link.Type}
+
+	up := 0.0
+	if link.State == "CONNECTED" {
+		up = 1
+	}
+	ch <- prometheus.MustNewConstMetric(meshLinkUpDesc, prometheus.GaugeValue, up, labels...)
+
+	factor := unitFactors["kbit/s"]
+	for _, rate := range []struct {
+		desc      *prometheus.Desc
+		value     float64
+		direction string
+	}{
+		{meshLinkRateDesc, link.CurRateRX, "rx"},
+		{meshLinkRateDesc, link.CurRateTX, "tx"},
+		{meshLinkMaxRateDesc, link.MaxRateRX, "rx"},
+		{meshLinkMaxRateDesc, link.MaxRateTX, "tx"},
+	} {
+		ch <- prometheus.MustNewConstMetric(rate.desc, prometheus.GaugeValue, rate.value*factor, append(labels, rate.direction)...)
+	}
+}
+
+func meshInterfaceName(ni *meshInterface) string {
+	if ni == nil {
+		return ""
+	}
+	return sanitizeLabelValue(ni.Name)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	lua "github.com/sberk42/fritzbox_exporter/fritzbox_lua"
+)
+
+// interval for checking which metrics are due for refresh
+const pollTickInterval = time.Second
+
+var lastSuccessDesc = prometheus.NewDesc(
+	"fritzbox_exporter_last_success_timestamp_seconds",
+	"Timestamp of the last successful refresh of the metric when polling in background.",
+	[]string{"metric", "action", "result"},
+	nil,
+)
+
+// pollState latest results of a metric refreshed in background
+type pollState struct {
+	next        time.Time // time of next refresh, cacheEntryTTL after the last refresh finished so the cached result expired
+	running     bool      // refresh in progress
+	lastSuccess time.Time
+
+	samples   []*metricSample // converted once per refresh, so errors are only counted by the poller
+	luaValues []lua.LuaMetricValue
+}
+
+// poller refreshes the metrics of a collector in background, so Collect only reports the latest results
+type poller struct {
+	sync.Mutex
+	upnp map[*Metric]*pollState
+	lua  map[*LuaMetric]*pollState
+
+	stats *scrapeStats // results of the last refresh of each action
+}
+
+func newPoller() *poller {
+	return &poller{
+		upnp:  make(map[*Metric]*pollState),
+		lua:   make(map[*LuaMetric]*pollState),
+		stats: newScrapeStats(),
+	}
+}
+
+// poll refreshes each metric every cacheEntryTTL seconds, runs forever
+func (fc *FritzboxCollector) poll() {
+	workers := make(chan struct{}, fc.workers)
+
+	ticker := time.NewTicker(pollTickInterval)
+	defer ticker.Stop()
+
+	for {
+		fc.pollDue(time.Now(), workers)
+		<-ticker.C
+	}
+}
+
+// pollDue starts the refresh of all metrics that are due
+func (fc *FritzboxCollector) pollDue(now time.Time, workers chan struct{}) {
+	fc.Lock()
+	root := fc.Root
+	metrics := fc.Metrics
+	luaMetrics := fc.LuaMetrics
+	labelRenames := fc.LabelRenames
+	fc.Unlock()
+
+	p := fc.poller
+	p.Lock()
+	defer p.Unlock()
+
+	// metrics are replaced when reloading, so states of removed metrics are dropped
+	upnpStates := make(map[*Metric]*pollState)
+	for _, m := range metrics {
+		state := p.upnp[m]
+		if state == nil {
+			state = &pollState{next: now}
+		}
+		upnpStates[m] = state
+
+		// upnp metrics can only be refreshed once services are loaded
+		if root == nil || state.running || now.Before(state.next) {
+			continue
+		}
+
+		state.running = true
+		go func(m *Metric, state *pollState) {
+			sc := &scrape{workers: workers, stats: newScrapeStats()}
+			results, ok := fc.getMetricResults(m, sc)
+			samples := make([]*metricSample, 0, len(results))
+			for _, result := range results {
+				if s, valid := fc.metricSample(m, result, sc.stats); valid {
+					samples = append(samples, s)
+				}
+			}
+			p.stats.merge(sc.stats)
+
+			p.Lock()
+			defer p.Unlock()
+
+			finished := time.Now()
+			state.running = false
+			state.next = finished.Add(time.Duration(m.CacheEntryTTL) * time.Second)
+			state.samples = samples
+			if ok {
+				state.lastSuccess = finished
+			}
+		}(m, state)
+	}
+	p.upnp = upnpStates
+
+	luaStates := make(map[*LuaMetric]*pollState)
+	for _, lm := range luaMetrics {
+		state := p.lua[lm]
+		if state == nil {
+			state = &pollState{next: now}
+		}
+		luaStates[lm] = state
+
+		if state.running || now.Before(state.next) {
+			continue
+		}
+
+		state.running = true
+		go func(lm *LuaMetric, state *pollState) {
+			sc := &scrape{workers: workers, stats: newScrapeStats()}
+			values := fc.getLuaMetricValues(lm, labelRenames, sc)
+			p.stats.merge(sc.stats)
+
+			p.Lock()
+			defer p.Unlock()
+
+			finished := time.Now()
+			state.running = false
+			state.next = finished.Add(time.Duration(lm.CacheEntryTTL) * time.Second)
+			state.luaValues = values
+			if values != nil {
+				state.lastSuccess = finished
+			}
+		}(lm, state)
+	}
+	p.lua = luaStates
+}
+
+// collectPolled reports the latest results of the background refresh in order of the metrics
+func (fc *FritzboxCollector) collectPolled(ch chan<- prometheus.Metric, metrics []*Metric, luaMetrics []*LuaMetric, dupCache map[string]bool) {
+	p := fc.poller
+	p.Lock()
+	defer p.Unlock()
+
+	// metrics with same name, action and result only differ by fixed labels, so report them once
+	reported := make(map[[3]string]bool)
+	reportLastSuccess := func(state *pollState, labels [3]string) {
+		if state.lastSuccess.IsZero() || reported[labels] {
+			return
+		}
+		reported[labels] = true
+
+		ts := float64(state.lastSuccess.UnixNano()) / 1e9
+		ch <- prometheus.MustNewConstMetric(lastSuccessDesc, prometheus.GaugeValue, ts, labels[0], labels[1], labels[2])
+	}
+
+	for _, m := range metrics {
+		state := p.upnp[m]
+		if state == nil {
+			continue
+		}
+
+		for _, s := range state.samples {
+			fc.sendMetric(ch, m, s, dupCache, false)
+		}
+
+		reportLastSuccess(state, [3]string{m.PromDesc.FqName, m.Action, m.Result})
+	}
+
+	for _, lm := range luaMetrics {
+		state := p.lua[lm]
+		if state == nil {
+			continue
+		}
+
+		for _, mv := range state.luaValues {
+			fc.reportLuaMetric(ch, lm, mv, dupCache, false)
+		}
+
+		reportLastSuccess(state, [3]string{lm.PromDesc.FqName, lm.Path, lm.ResultPath + "." + lm.ResultKey})
+	}
+
+	p.stats.collect(ch)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+// probe module collecting all collectors enabled for the target, other modules are the collector names
+const moduleDefault = "default"
+
+type collectorKey struct {
+	target string
+	module string
+}
+
+// probeCollectors collectors created for probed targets, reused across probes
+type probeCollectors struct {
+	sync.Mutex
+	targets    map[string]*TargetConfig // targets by name
+	byName     bool                     // only configured targets can be probed
+	base       *TargetConfig            // template for targets given by host name
+	hosts      map[string]bool          // hosts allowed as target if not probing by name
+	collectors map[collectorKey]*FritzboxCollector
+}
+
+var probeTargets probeCollectors
+
+// init sets the targets available for probing.
+// If byName is false the first target is used as template for the hosts given, other hosts can't be probed, so the
+// credentials are never sent to a host chosen by the caller.
+func (pc *probeCollectors) init(targets []*TargetConfig, byName bool, hosts []string) {
+	pc.Lock()
+	defer pc.Unlock()
+
+	pc.targets = make(map[string]*TargetConfig)
+	for _, tc := range targets {
+		pc.targets[tc.Name] = tc
+	}
+	pc.byName = byName
+	pc.base = targets[0]
+	pc.hosts = make(map[string]bool)
+	for _, host := range hosts {
+		pc.hosts[host] = true
+	}
+	pc.collectors = make(map[collectorKey]*FritzboxCollector)
+}
+
+// defaultTarget returns the name of the first target, which is also collected by /metrics
+func (pc *probeCollectors) defaultTarget() string {
+	pc.Lock()
+	defer pc.Unlock()
+
+	return pc.base.Name
+}
+
+// replaceHost replaces the hostname of rawURL with host, scheme and port are kept
+func replaceHost(rawURL string, host string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	if port := u.Port(); port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		u.Host = "[" + host + "]" // IPv6 address
+	} else {
+		u.Host = host
+	}
+
+	return u.String(), nil
+}
+
+// targetForHost creates a target for host using scheme, port and settings of the base target
+func (pc *probeCollectors) targetForHost(host string) (*TargetConfig, error) {
+	if strings.ContainsAny(host, "/?#@[] ") {
+		return nil, fmt.Errorf("invalid target '%s', only host name or IP address supported", host)
+	}
+
+	tc := *pc.base
+	tc.Name = host
+
+	var err error
+	if tc.GatewayURL != "" {
+		tc.GatewayURL, err = replaceHost(tc.GatewayURL, host)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if tc.GatewayLuaURL != "" {
+		tc.GatewayLuaURL, err = replaceHost(tc.GatewayLuaURL, host)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &tc, nil
+}
+
+// get returns the collector for target and module, creating it on first use
+func (pc *probeCollectors) get(target string, module string) (*FritzboxCollector, error) {
+	pc.Lock()
+	defer pc.Unlock()
+
+	key := collectorKey{target: target, module: module}
+	fc, ok := pc.collectors[key]
+	if ok {
+		return fc, nil
+	}
+
+	tc, ok := pc.targets[target]
+	if !ok {
+		if pc.byName {
+			return nil, fmt.Errorf("unknown target '%s'", target)
+		}
+		if !pc.hosts[target] {
+			return nil, fmt.Errorf("target '%s' is not allowed, add it to -probe-hosts", target)
+		}
+
+		var err error
+		tc, err = pc.targetForHost(target)
+		if err != nil {
+			return nil, err
+		}
+		pc.targets[target] = tc // remember target for reloading
+	}
+
+	collectors := tc.Collectors
+	if module != moduleDefault {
+		if !tc.hasCollector(module) {
+			return nil, fmt.Errorf("module '%s' is not enabled for target '%s', enabled: %s", module, target, strings.Join(tc.Collectors, ", "))
+		}
+
+		collectors = []string{module}
+	}
+
+	fc = newCollector(tc, collectors)
+	if fc.withServices {
+		// like for /metrics the services are loaded in background, starting with the cached services if available
+		go fc.LoadServices()
+	}
+
+	logrus.Infof("created collector for target %s (module %s)", target, module)
+	pc.collectors[key] = fc
+
+	return fc, nil
+}
+
+// probeHandler collects the metrics of the target given as parameter (blackbox exporter style)
+func probeHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	target := params.Get("target")
+	if target == "" {
+		http.Error(w, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+
+	module := params.Get("module")
+	if module == "" {
+		module = moduleDefault
+	}
+
+	fc, err := probeTargets.get(target, module)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(fc)
+
+	h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	h.ServeHTTP(w, r)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	configReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "fritzbox_exporter_config_last_reload_successful",
+		Help: "Whether the last reload of the metric definitions was successful.",
+	})
+	configReloadSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "fritzbox_exporter_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful reload of the metric definitions.",
+	})
+)
+
+// reload re-reads the metric files of all targets and replaces the definitions of all collectors.
+// If any file is invalid nothing is replaced.
+func (pc *probeCollectors) reload() error {
+	pc.Lock()
+	defer pc.Unlock()
+
+	ce := &configError{file: "metric files"}
+	cache := make(metricFileCache)
+	defs := make(map[string]*metricDefinitions)
+
+	for name, tc := range pc.targets {
+		defs[name] = tc.loadDefinitions(ce, tc.fieldPrefix(), cache)
+	}
+
+	if len(ce.problems) > 0 {
+		return ce
+	}
+
+	for name, tc := range pc.targets {
+		tc.defs = defs[name]
+	}
+
+	for key, fc := range pc.collectors {
+		fc.setDefinitions(defs[key.target])
+	}
+
+	return nil
+}
+
+// reloadMetrics reloads the metric definitions and updates the reload metrics
+func reloadMetrics() error {
+	err := probeTargets.reload()
+	if err != nil {
+		configReloadSuccess.Set(0)
+		logrus.Errorf("reloading metric definitions failed, keeping current ones: %s", err)
+		return err
+	}
+
+	configReloadSuccess.Set(1)
+	configReloadSeconds.SetToCurrentTime()
+	logrus.Info("metric definitions reloaded")
+
+	return nil
+}
+
+// reloadHandler reloads the metric definitions on POST requests
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := reloadMetrics()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to reload metric definitions: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintln(w, "metric definitions reloaded")
+}
+
+// handleReloadSignal reloads the metric definitions whenever SIGHUP is received
+func handleReloadSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			reloadMetrics()
+		}
+	}()
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"net"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	upnp "github.com/sberk42/fritzbox_exporter/fritzbox_upnp"
+)
+
+// service label used for lua pages, action is the page
+const luaService = "lua"
+
+// error causes, SOAP faults and HTTP status use the code as suffix
+const (
+	causeSoapFault     = "soap_fault_"
+	causeHTTPStatus    = "http_"
+	causeAuth          = "auth"
+	causeParse         = "parse"
+	causeTransform     = "transform"
+	causeMissingResult = "missing_result"
+	causeConnection    = "connection"
+	causeOther         = "other"
+)
+
+var (
+	scrapeDurationDesc = prometheus.NewDesc(
+		"fritzbox_exporter_scrape_duration_seconds",
+		"Duration of the calls to the FRITZ!Box for the action or lua page, 0 if all results were cached.",
+		[]string{"service", "action"},
+		nil,
+	)
+	scrapeSuccessDesc = prometheus.NewDesc(
+		"fritzbox_exporter_scrape_success",
+		"Whether all calls and results of the action or lua page were successful.",
+		[]string{"service", "action"},
+		nil,
+	)
+
+	collectErrorCauses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "fritzbox_exporter_collect_errors_total",
+		Help: "Number of collection errors by service, action (or lua page) and cause.",
+	}, []string{"service", "action", "cause"})
+)
+
+// formats of the errors returned by LuaSession.LoadData
+var (
+	httpStatusRegex = regexp.MustCompile(`failed: (\d{3}) `)
+	authRegex       = regexp.MustCompile(`login failed|login blocked`)
+	parseRegex      = regexp.MustCompile(`decoding|parsing|unknown datatype`)
+)
+
+// errorCause classifies the error for the error counter
+func errorCause(err error) string {
+	var sfe *upnp.SoapFaultError
+	var hse *upnp.HTTPStatusError
+	var ae *upnp.AuthError
+	var syntaxErr *xml.SyntaxError
+	var numErr *strconv.NumError
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, errTransform):
+		return causeTransform
+	case errors.As(err, &sfe):
+		return causeSoapFault + strconv.Itoa(sfe.Code)
+	case errors.As(err, &hse):
+		return causeHTTPStatus + strconv.Itoa(hse.StatusCode)
+	case errors.As(err, &ae):
+		return causeAuth
+	case errors.As(err, &netErr):
+		return causeConnection
+	case errors.As(err, &syntaxErr), errors.As(err, &numErr):
+		return causeParse
+	}
+
+	msg := err.Error()
+	if m := httpStatusRegex.FindStringSubmatch(msg); m != nil {
+		if m[1] == "401" || m[1] == "403" {
+			return causeAuth
+		}
+		return causeHTTPStatus + m[1]
+	}
+
+	switch {
+	case authRegex.MatchString(msg):
+		return causeAuth
+	case parseRegex.MatchString(msg):
+		return causeParse
+	}
+
+	return causeOther
+}
+
+type scrapeKey struct {
+	service string
+	action  string
+}
+
+type scrapeResult struct {
+	duration time.Duration
+	success  bool
+}
+
+// scrapeStats duration and success of the actions and lua pages of a scrape
+type scrapeStats struct {
+	sync.Mutex
+	results map[scrapeKey]*scrapeResult
+}
+
+func newScrapeStats() *scrapeStats {
+	return &scrapeStats{results: make(map[scrapeKey]*scrapeResult)}
+}
+
+// record adds the duration of a call, the action stays failed if any call failed.
+// Errors are counted by cause, use cause "" to classify err.
+func (s *scrapeStats) record(service string, action string, duration time.Duration, err error, cause string) {
+	if err != nil {
+		if cause == "" {
+			cause = errorCause(err)
+		}
+		collectErrorCauses.WithLabelValues(service, action, cause).Inc()
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	key := scrapeKey{service: service, action: action}
+	res, ok := s.results[key]
+	if !ok {
+		res = &scrapeResult{success: true}
+		s.results[key] = res
+	}
+
+	res.duration += duration
+	if err != nil {
+		res.success = false
+	}
+}
+
+// skip marks the action as failed without counting an error, used for actions not called because of previous errors
+func (s *scrapeStats) skip(service string, action string) {
+	s.Lock()
+	defer s.Unlock()
+
+	key := scrapeKey{service: service, action: action}
+	res, ok := s.results[key]
+	if !ok {
+		res = &scrapeResult{}
+		s.results[key] = res
+	}
+	res.success = false
+}
+
+// merge replaces the results of all actions contained in other
+func (s *scrapeStats) merge(other *scrapeStats) {
+	other.Lock()
+	defer other.Unlock()
+	s.Lock()
+	defer s.Unlock()
+
+	for key, res := range other.results {
+		s.results[key] = res
+	}
+}
+
+func (s *scrapeStats) collect(ch chan<- prometheus.Metric) {
+	s.Lock()
+	defer s.Unlock()
+
+	for key, res := range s.results {
+		success := 0.0
+		if res.success {
+			success = 1
+		}
+
+		ch <- prometheus.MustNewConstMetric(scrapeDurationDesc, prometheus.GaugeValue, res.duration.Seconds(), key.service, key.action)
+		ch <- prometheus.MustNewConstMetric(scrapeSuccessDesc, prometheus.GaugeValue, success, key.service, key.action)
+	}
+}
+
+// scrape state shared by all calls of a collection or background refresh
+type scrape struct {
+	workers chan struct{} // limits the number of concurrent calls to the FRITZ!Box
+	stats   *scrapeStats
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	upnp "github.com/sberk42/fritzbox_exporter/fritzbox_upnp"
+)
+
+// characters replaced in the names of cache files
+var cacheFileNameRegex = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// serviceCache stores the service trees by model and firmware, so collectors can start without the FRITZ!Box.
+// For each target the key of the tree loaded last is stored, as model and firmware are only known after loading.
+type serviceCache struct {
+	dir    string
+	target string
+}
+
+// cacheKey returns the key of the service tree by model and firmware
+func cacheKey(root *upnp.Root) string {
+	firmware := "unknown"
+	if root.SystemVersion != nil && root.SystemVersion.Display != "" {
+		firmware = root.SystemVersion.Display
+	}
+
+	return cacheFileName(root.Device.ModelName + "_" + firmware)
+}
+
+func cacheFileName(name string) string {
+	return strings.Trim(cacheFileNameRegex.ReplaceAllString(name, "_"), "_")
+}
+
+func (c *serviceCache) servicesFile(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+func (c *serviceCache) targetFile() string {
+	return filepath.Join(c.dir, "target_"+cacheFileName(c.target)+".key")
+}
+
+// load loads the service tree last stored for the target
+func (c *serviceCache) load(fc *FritzboxCollector) (*upnp.Root, error) {
+	key, err := ioutil.ReadFile(c.targetFile())
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := upnp.LoadServicesFromFile(c.servicesFile(strings.TrimSpace(string(key))), fc.URL, fc.Username, fc.Password, fc.HTTPClient)
+	if err != nil {
+		return nil, fmt.Errorf("error loading cached services of %s: %w", strings.TrimSpace(string(key)), err)
+	}
+
+	return root, nil
+}
+
+// save stores the service tree and remembers its key for the target
+func (c *serviceCache) save(root *upnp.Root) error {
+	err := os.MkdirAll(c.dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	key := cacheKey(root)
+	file := c.servicesFile(key)
+
+	// files are renamed after writing, so a cache file is never partly written
+	err = root.SaveServices(file + ".tmp")
+	if err == nil {
+		err = os.Rename(file+".tmp", file)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing services cache %s: %w", file, err)
+	}
+
+	targetFile := c.targetFile()
+	err = ioutil.WriteFile(targetFile+".tmp", []byte(key+"\n"), 0644)
+	if err == nil {
+		err = os.Rename(targetFile+".tmp", targetFile)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing services cache %s: %w", targetFile, err)
+	}
+
+	return nil
+}
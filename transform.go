@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// values of parse
+const (
+	parseDuration = "duration"
+	parseDateTime = "dateTime"
+)
+
+// factors converting units to the base units used by prometheus
+var unitFactors = map[string]float64{
+	// time to seconds
+	"ms":  1e-3,
+	"us":  1e-6,
+	"min": 60,
+	"h":   3600,
+	"d":   86400,
+
+	// rates to bytes per second
+	"bit/s":  1.0 / 8,
+	"kbit/s": 1e3 / 8,
+	"Mbit/s": 1e6 / 8,
+	"Gbit/s": 1e9 / 8,
+
+	// sizes to bytes
+	"kB":  1e3,
+	"MB":  1e6,
+	"GB":  1e9,
+	"KiB": 1 << 10,
+	"MiB": 1 << 20,
+	"GiB": 1 << 30,
+
+	// electrical units to W, V, A and Wh to joule
+	"mW": 1e-3,
+	"mV": 1e-3,
+	"mA": 1e-3,
+	"Wh": 3600,
+
+	// percent to ratio
+	"%": 1e-2,
+}
+
+// formats tried for dateTime values if no layout is given
+var dateTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	"02.01.06 15:04",
+	"02.01.2006 15:04:05",
+}
+
+// durations as [<days>d ]<hours>:<minutes>[:<seconds>], e.g. "3d 04:05:06"
+var clockDurationRegex = regexp.MustCompile(`^(?:(\d+)\s*d\s*)?(\d+):(\d{2})(?::(\d{2}))?$`)
+
+// days in go durations, e.g. "3d4h"
+var daysDurationRegex = regexp.MustCompile(`^(\d+)d(.*)$`)
+
+// errTransform is wrapped by all errors converting a value
+var errTransform = errors.New("cannot transform value")
+
+// ValueTransform converts a result to the metric value, the steps are applied in order of the fields
+type ValueTransform struct {
+	Regex  string             `json:"regex"`  // value is replaced by the first group (or the whole match)
+	Map    map[string]float64 `json:"map"`    // value to number, values not in map are errors
+	Parse  string             `json:"parse"`  // "duration" (to seconds) or "dateTime" (to Unix seconds)
+	Layout string             `json:"layout"` // go time layout for dateTime, common formats are tried if not set
+	Unit   string             `json:"unit"`   // unit of the value, converted to the base unit (e.g. kbit/s to bytes/s)
+	Scale  *float64           `json:"scale"`  // factor, 1 if not set
+	Offset float64            `json:"offset"` // added after scaling
+
+	regex  *regexp.Regexp
+	factor float64 // factor of the unit times scale
+}
+
+// init checks the transform and compiles the regex
+func (t *ValueTransform) init() error {
+	if t.Regex != "" {
+		regex, err := regexp.Compile(t.Regex)
+		if err != nil {
+			return fmt.Errorf("invalid regex: %s", err.Error())
+		}
+		t.regex = regex
+	}
+
+	switch t.Parse {
+	case "", parseDuration, parseDateTime:
+	default:
+		return fmt.Errorf("unknown parse %s, supported: %s, %s", t.Parse, parseDuration, parseDateTime)
+	}
+
+	if t.Map != nil && t.Parse != "" {
+		return fmt.Errorf("map and parse can't be combined")
+	}
+
+	if t.Layout != "" && t.Parse != parseDateTime {
+		return fmt.Errorf("layout is only used with parse %s", parseDateTime)
+	}
+
+	t.factor = 1
+	if t.Unit != "" {
+		factor, ok := unitFactors[t.Unit]
+		if !ok {
+			return fmt.Errorf("unknown unit %s", t.Unit)
+		}
+		t.factor = factor
+	}
+
+	if t.Scale != nil {
+		if *t.Scale == 0 {
+			return fmt.Errorf("scale 0 makes every value 0")
+		}
+		t.factor *= *t.Scale
+	}
+
+	return nil
+}
+
+// apply converts the value, errors wrap errTransform
+func (t *ValueTransform) apply(value interface{}) (float64, error) {
+	sval := strings.TrimSpace(formatValue(value))
+
+	if t.regex != nil {
+		match := t.regex.FindStringSubmatch(sval)
+		if match == nil {
+			return 0, fmt.Errorf("%w: '%s' does not match %s", errTransform, sval, t.Regex)
+		}
+
+		sval = match[0]
+		if len(match) > 1 {
+			sval = match[1]
+		}
+	}
+
+	var fval float64
+	var err error
+	switch {
+	case t.Map != nil:
+		var ok bool
+		fval, ok = t.Map[sval]
+		if !ok {
+			return 0, fmt.Errorf("%w: '%s' is not mapped", errTransform, sval)
+		}
+	case t.Parse == parseDuration:
+		fval, err = parseDurationSeconds(sval)
+	case t.Parse == parseDateTime:
+		fval, err = t.parseDateTime(sval)
+	default:
+		fval, err = toFloat(value, sval)
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", errTransform, err.Error())
+	}
+
+	return fval*t.factor + t.Offset, nil
+}
+
+// toFloat converts numbers, bools and times (to Unix seconds, 0 if not set) directly and parses all other values
+func toFloat(value interface{}, sval string) (float64, error) {
+	switch tval := value.(type) {
+	case uint64:
+		return float64(tval), nil
+	case int64:
+		return float64(tval), nil
+	case float64:
+		return tval, nil
+	case bool:
+		if tval {
+			return 1, nil
+		}
+		return 0, nil
+	case time.Time:
+		if tval.IsZero() {
+			return 0, nil
+		}
+		return float64(tval.Unix()), nil
+	}
+
+	fval, err := strconv.ParseFloat(sval, 64)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' is no number", sval)
+	}
+	return fval, nil
+}
+
+// resultValue converts a result without transform, strings are 1 if they equal okValue (else 0) or parsed as
+// number if there is no okValue
+func resultValue(value interface{}, okValue string) (float64, error) {
+	if sval, ok := value.(string); ok && okValue != "" {
+		if sval == okValue {
+			return 1, nil
+		}
+		return 0, nil
+	}
+
+	return toFloat(value, strings.TrimSpace(formatValue(value)))
+}
+
+// formatValue formats results for labels and arguments, times in the format of the FRITZ!Box
+func formatValue(value interface{}) string {
+	if t, ok := value.(time.Time); ok {
+		return t.Format("2006-01-02T15:04:05")
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// parseDurationSeconds parses plain seconds, go durations (with days) and clock durations
+func parseDurationSeconds(sval string) (float64, error) {
+	if fval, err := strconv.ParseFloat(sval, 64); err == nil {
+		return fval, nil
+	}
+
+	if m := clockDurationRegex.FindStringSubmatch(sval); m != nil {
+		var seconds float64
+		for i, factor := range []float64{86400, 3600, 60, 1} {
+			if m[i+1] != "" {
+				n, _ := strconv.Atoi(m[i+1])
+				seconds += float64(n) * factor
+			}
+		}
+		return seconds, nil
+	}
+
+	var days float64
+	if m := daysDurationRegex.FindStringSubmatch(sval); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		days = float64(n)
+		sval = m[2]
+		if sval == "" {
+			return days * 86400, nil
+		}
+	}
+
+	d, err := time.ParseDuration(sval)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' is no duration", sval)
+	}
+	return days*86400 + d.Seconds(), nil
+}
+
+// parseDateTime parses the time using the layout or the common formats, times without zone are local
+func (t *ValueTransform) parseDateTime(sval string) (float64, error) {
+	layouts := dateTimeLayouts
+	if t.Layout != "" {
+		layouts = []string{t.Layout}
+	}
+
+	for _, layout := range layouts {
+		ts, err := time.ParseInLocation(layout, sval, time.Local)
+		if err == nil {
+			return float64(ts.Unix()), nil
+		}
+	}
+
+	return 0, fmt.Errorf("'%s' is no dateTime", sval)
+}
+
+// stateIndex returns the index of the value in the states of a state set
+func stateIndex(states []string, value interface{}) (float64, error) {
+	sval := strings.TrimSpace(fmt.Sprintf("%v", value))
+	for i, state := range states {
+		if state == sval {
+			return float64(i), nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: '%s' is not one of the states %s", errTransform, sval, strings.Join(states, ", "))
+}
+
+// sanitizeLabelValue replaces invalid UTF-8 and control characters, collapses white space and truncates the value to
+// maxInfoLabelLength characters
+func sanitizeLabelValue(value string) string {
+	value = strings.ToValidUTF8(value, "\uFFFD")
+	value = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, value)
+	value = strings.Join(strings.Fields(value), " ")
+
+	if runes := []rune(value); len(runes) > maxInfoLabelLength {
+		value = string(runes[:maxInfoLabelLength])
+	}
+
+	return value
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func float64Ptr(f float64) *float64 {
+	return &f
+}
+
+func TestValueTransformApply(t *testing.T) {
+	tests := []struct {
+		name      string
+		transform ValueTransform
+		value     interface{}
+		want      float64
+		err       bool
+	}{
+		{"number", ValueTransform{}, "42", 42, false},
+		{"uint64", ValueTransform{}, uint64(7), 7, false},
+		{"bool", ValueTransform{}, true, 1, false},
+		{"no number", ValueTransform{}, "up", 0, true},
+		{"regex group", ValueTransform{Regex: `(\d+) dB`}, "SNR 35 dB", 35, false},
+		{"regex match", ValueTransform{Regex: `\d+`}, "v42", 42, false},
+		{"regex no match", ValueTransform{Regex: `\d+`}, "none", 0, true},
+		{"map", ValueTransform{Map: map[string]float64{"Up": 1, "Down": 0}}, " Up ", 1, false},
+		{"not mapped", ValueTransform{Map: map[string]float64{"Up": 1}}, "Training", 0, true},
+		{"duration seconds", ValueTransform{Parse: parseDuration}, "90", 90, false},
+		{"duration clock", ValueTransform{Parse: parseDuration}, "3d 04:05:06", 273906, false},
+		{"duration go", ValueTransform{Parse: parseDuration}, "2d3h", 183600, false},
+		{"no duration", ValueTransform{Parse: parseDuration}, "soon", 0, true},
+		{"dateTime layout", ValueTransform{Parse: parseDateTime, Layout: "02.01.2006 15:04 -0700"}, "01.05.2021 12:00 +0200", 1619863200, false},
+		{"dateTime RFC 3339", ValueTransform{Parse: parseDateTime}, "2021-05-01T10:00:00Z", 1619863200, false},
+		{"unit", ValueTransform{Unit: "kbit/s"}, "8", 1000, false},
+		{"scale", ValueTransform{Scale: float64Ptr(0.1)}, "-35", -3.5, false},
+		{"unit and scale", ValueTransform{Unit: "Mbit/s", Scale: float64Ptr(2)}, "4", 1e6, false},
+		{"offset after scale", ValueTransform{Scale: float64Ptr(0.5), Offset: -10}, "30", 5, false},
+		{"regex, map and offset", ValueTransform{Regex: `^(\w+)`, Map: map[string]float64{"on": 1}, Offset: 1}, "on (2.4 GHz)", 2, false},
+	}
+
+	for _, tt := range tests {
+		if err := tt.transform.init(); err != nil {
+			t.Errorf("%s: init: %v", tt.name, err)
+			continue
+		}
+
+		got, err := tt.transform.apply(tt.value)
+		if tt.err {
+			if !errors.Is(err, errTransform) {
+				t.Errorf("%s: got error %v, want transform error", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValueTransformInit(t *testing.T) {
+	tests := []struct {
+		name      string
+		transform ValueTransform
+	}{
+		{"invalid regex", ValueTransform{Regex: "("}},
+		{"unknown parse", ValueTransform{Parse: "number"}},
+		{"map and parse", ValueTransform{Map: map[string]float64{"a": 1}, Parse: parseDuration}},
+		{"layout without dateTime", ValueTransform{Layout: "2006"}},
+		{"unknown unit", ValueTransform{Unit: "furlong"}},
+		{"scale 0", ValueTransform{Scale: float64Ptr(0)}},
+	}
+
+	for _, tt := range tests {
+		if err := tt.transform.init(); err == nil {
+			t.Errorf("%s: got no error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	upnp "github.com/sberk42/fritzbox_exporter/fritzbox_upnp"
+)
+
+// metricFamilyDef labels and help of a metric name, all definitions for the same name must match
+type metricFamilyDef struct {
+	labels string
+	help   string
+	where  string
+}
+
+// validator checks metric files and reports all problems found
+type validator struct {
+	problems int
+	families map[string]*metricFamilyDef
+}
+
+func (v *validator) report(where string, format string, args ...interface{}) {
+	v.problems++
+	fmt.Printf("%s: %s\n", where, fmt.Sprintf(format, args...))
+}
+
+// position returns file:line:col for the offset, leading whitespace and commas are skipped
+func position(file string, data []byte, offset int64) string {
+	for offset < int64(len(data)) && strings.IndexByte(" \t\r\n,", data[offset]) >= 0 {
+		offset++
+	}
+
+	line := 1 + bytes.Count(data[:offset], []byte("\n"))
+	col := int(offset) - bytes.LastIndexByte(data[:offset], '\n')
+
+	return fmt.Sprintf("%s:%d:%d", file, line, col)
+}
+
+// errorPosition returns the position for JSON errors containing an offset
+func errorPosition(file string, data []byte, err error) string {
+	switch jerr := err.(type) {
+	case *json.SyntaxError:
+		return position(file, data, jerr.Offset)
+	case *json.UnmarshalTypeError:
+		return position(file, data, jerr.Offset)
+	}
+
+	return file
+}
+
+// elementOffsets returns the offsets of the elements of the top level array (key == "")
+// or of the array stored as key in the top level object
+func elementOffsets(data []byte, key string) ([]int64, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	if key != "" {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if t != json.Delim('{') {
+			return nil, fmt.Errorf("expected object")
+		}
+
+		found := false
+		for dec.More() && !found {
+			t, err = dec.Token()
+			if err != nil {
+				return nil, err
+			}
+
+			if t == key {
+				found = true
+			} else {
+				var skip json.RawMessage
+				err = dec.Decode(&skip)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if !found {
+			return nil, nil
+		}
+	}
+
+	t, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if t != json.Delim('[') {
+		return nil, fmt.Errorf("expected array")
+	}
+
+	offsets := make([]int64, 0)
+	for dec.More() {
+		offsets = append(offsets, dec.InputOffset())
+
+		var skip json.RawMessage
+		err = dec.Decode(&skip)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return offsets, nil
+}
+
+// readMetricFile reads the file, unmarshals it into out and returns the positions of the metrics
+func (v *validator) readMetricFile(file string, out interface{}, key string) ([]byte, []int64, bool) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		v.report(file, "%s", err.Error())
+		return nil, nil, false
+	}
+
+	err = json.Unmarshal(data, out)
+	if err != nil {
+		v.report(errorPosition(file, data, err), "%s", err.Error())
+		return nil, nil, false
+	}
+
+	offsets, err := elementOffsets(data, key)
+	if err != nil {
+		v.report(file, "%s", err.Error())
+		return nil, nil, false
+	}
+
+	return data, offsets, true
+}
+
+func (v *validator) checkPromType(where string, promType string) {
+	switch promType {
+	case "", "CounterValue", "GaugeValue", "UntypedValue", promTypeStateSet, promTypeInfo:
+	default:
+		v.report(where, "unknown promType '%s', supported: CounterValue, GaugeValue, UntypedValue, %s, %s", promType, promTypeStateSet, promTypeInfo)
+	}
+}
+
+// checkTransform checks the transform, okValue is not used with a transform
+func (v *validator) checkTransform(where string, t *ValueTransform, okValue string) {
+	if t == nil {
+		return
+	}
+
+	if okValue != "" {
+		v.report(where, "okValue is not used with a transform, map the value instead")
+	}
+
+	err := t.init()
+	if err != nil {
+		v.report(where, "invalid transform: %s", err.Error())
+	}
+}
+
+func (v *validator) checkValueOptions(where string, promType string, states []string, t *ValueTransform, okValue string) {
+	err := checkValueOptions(promType, states, t, okValue)
+	if err != nil {
+		v.report(where, "%s", err.Error())
+	}
+}
+
+// checkPromDesc checks the descriptor and that all metrics with the same name have the same labels and help
+func (v *validator) checkPromDesc(where string, pd *JSONPromDesc, promType string) {
+	varLabels := descLabels(pd, promType)
+	labels := append([]string{}, varLabels...)
+	for l := range pd.FixedLabels {
+		labels = append(labels, l)
+	}
+
+	err := checkDescs([]*prometheus.Desc{prometheus.NewDesc(pd.FqName, pd.Help, varLabels, pd.FixedLabels)})
+	if err != nil {
+		v.report(where, "%s", err.Error())
+		return
+	}
+
+	sort.Strings(labels)
+	fd := &metricFamilyDef{labels: strings.Join(labels, ","), help: pd.Help, where: where}
+
+	prev, ok := v.families[pd.FqName]
+	if !ok {
+		v.families[pd.FqName] = fd
+		return
+	}
+
+	if prev.labels != fd.labels {
+		v.report(where, "metric %s has labels [%s], but labels [%s] at %s", pd.FqName, fd.labels, prev.labels, prev.where)
+	}
+	if prev.help != fd.help {
+		v.report(where, "metric %s has help '%s', but '%s' at %s", pd.FqName, fd.help, prev.help, prev.where)
+	}
+}
+
+// stateVarArgument returns the argument of the action related to the state variable
+func stateVarArgument(a *upnp.Action, stateVar string) *upnp.Argument {
+	for _, arg := range a.Arguments {
+		if arg.RelatedStateVariable == stateVar {
+			return arg
+		}
+	}
+	return nil
+}
+
+func outArguments(a *upnp.Action) string {
+	names := make([]string, 0)
+	for _, arg := range a.Arguments {
+		if arg.Direction == "out" {
+			names = append(names, arg.RelatedStateVariable)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// checkResult checks that the action returns the state variable and returns its data type
+func (v *validator) checkResult(where string, service string, a *upnp.Action, stateVar string, what string) string {
+	arg := stateVarArgument(a, stateVar)
+	if arg == nil {
+		v.report(where, "%s %s is not returned by %s.%s, results: %s", what, stateVar, service, a.Name, outArguments(a))
+		return ""
+	}
+
+	if arg.Direction != "out" {
+		v.report(where, "%s %s is an input argument of %s.%s", what, stateVar, service, a.Name)
+		return ""
+	}
+
+	if arg.StateVariable == nil {
+		v.report(where, "%s %s has no state variable in %s", what, stateVar, service)
+		return ""
+	}
+
+	return arg.StateVariable.DataType
+}
+
+func isIntegerType(dataType string) bool {
+	switch dataType {
+	case "ui1", "ui2", "ui4", "ui8", "i1", "i2", "i4", "i8":
+		return true
+	}
+	return false
+}
+
+func (v *validator) checkDataType(where string, m *Metric, dataType string) {
+	if m.Transform != nil || m.PromType == promTypeStateSet {
+		// transforms and state sets accept all data types
+		return
+	}
+
+	switch dataType {
+	case "":
+		// already reported
+	case "ui1", "ui2", "ui4", "ui8", "i1", "i2", "i4", "i8", "r4", "r8", "number", "float", "fixed.14.4", "dateTime":
+		if m.OkValue != "" {
+			v.report(where, "okValue is only used for string results, %s is %s", m.Result, dataType)
+		}
+	case "boolean":
+		if m.PromType == "CounterValue" {
+			v.report(where, "boolean result %s can't be a counter", m.Result)
+		}
+	case "string", "uuid", "char":
+		if m.OkValue == "" {
+			v.report(where, "string result %s needs an okValue (or a transform or promType %s, %s)", m.Result, promTypeStateSet, promTypeInfo)
+		}
+		if m.PromType == "CounterValue" {
+			v.report(where, "string result %s can't be a counter", m.Result)
+		}
+	default:
+		v.report(where, "data type %s of result %s is not supported", dataType, m.Result)
+	}
+}
+
+func (v *validator) checkActionArgument(where string, m *Metric, service *upnp.Service, action *upnp.Action) {
+	inArgs := make([]string, 0)
+	for _, arg := range action.Arguments {
+		if arg.Direction == "in" {
+			inArgs = append(inArgs, arg.Name)
+		}
+	}
+
+	given := make(map[string]bool)
+	for _, aa := range m.ActionArgument {
+		if given[aa.Name] {
+			v.report(where, "argument %s of %s.%s is given more than once", aa.Name, m.Service, m.Action)
+		}
+
+		v.checkArgument(where, m, service, action, aa, inArgs, given)
+		given[aa.Name] = true
+	}
+
+	for _, name := range inArgs {
+		if !given[name] {
+			v.report(where, "%s.%s requires input argument %s, input arguments: %s", m.Service, m.Action, name, strings.Join(inArgs, ", "))
+		}
+	}
+}
+
+// checkArgument checks a single argument, preceding contains the arguments resolved before
+func (v *validator) checkArgument(where string, m *Metric, service *upnp.Service, action *upnp.Action, aa *ActionArg, inArgs []string, preceding map[string]bool) {
+	arg, ok := action.ArgumentMap[aa.Name]
+	if !ok {
+		v.report(where, "%s.%s has no argument %s, input arguments: %s", m.Service, m.Action, aa.Name, strings.Join(inArgs, ", "))
+	} else if arg.Direction != "in" {
+		v.report(where, "argument %s of %s.%s is not an input argument", aa.Name, m.Service, m.Action)
+	}
+
+	if aa.ProviderAction != "" {
+		provider, ok := service.Actions[aa.ProviderAction]
+		if !ok {
+			v.report(where, "provider action %s not found in service %s", aa.ProviderAction, m.Service)
+			return
+		}
+
+		for _, arg := range provider.Arguments {
+			if arg.Direction == "in" && !preceding[arg.Name] {
+				v.report(where, "provider action %s requires input argument %s, it must be given before %s", aa.ProviderAction, arg.Name, aa.Name)
+			}
+		}
+
+		dataType := v.checkResult(where, m.Service, provider, aa.Value, "provider result")
+		if aa.IsIndex && dataType != "" && !isIntegerType(dataType) {
+			v.report(where, "provider result %s used as index count has data type %s", aa.Value, dataType)
+		}
+	} else if aa.IsIndex {
+		var count int
+		_, err := fmt.Sscanf(aa.Value, "%d", &count)
+		if err != nil {
+			v.report(where, "index count '%s' is not a number", aa.Value)
+		}
+	}
+}
+
+func (v *validator) checkMetric(where string, m *Metric, root *upnp.Root) {
+	if m.Service == "" || m.Action == "" || (m.Result == "" && m.PromType != promTypeInfo) {
+		v.report(where, "service, action and result are required")
+		return
+	}
+
+	v.checkPromType(where, m.PromType)
+	v.checkPromDesc(where, &m.PromDesc, m.PromType)
+	v.checkTransform(where, m.Transform, m.OkValue)
+	v.checkValueOptions(where, m.PromType, m.States, m.Transform, m.OkValue)
+
+	if root == nil {
+		return
+	}
+
+	service, ok := root.Services[m.Service]
+	if !ok {
+		v.report(where, "service %s not found", m.Service)
+		return
+	}
+
+	action, ok := service.Actions[m.Action]
+	if !ok {
+		v.report(where, "action %s not found in service %s", m.Action, m.Service)
+		return
+	}
+
+	v.checkActionArgument(where, m, service, action)
+
+	if m.PromType != promTypeInfo {
+		dataType := v.checkResult(where, m.Service, action, m.Result, "result")
+		v.checkDataType(where, m, dataType)
+	} else if m.Result != "" {
+		v.report(where, "result is not used for promType %s", promTypeInfo)
+	}
+
+	labelActions := v.checkLabelActions(where, m, root)
+
+	for _, l := range m.PromDesc.VarLabels {
+		if l != "gateway" && !isProviderResult(m, service, l) && !isLabelActionResult(labelActions, l) {
+			v.checkResult(where, m.Service, action, l, "label")
+		}
+	}
+}
+
+// checkLabelActions checks the label actions exist and their input arguments are given for the metric
+func (v *validator) checkLabelActions(where string, m *Metric, root *upnp.Root) []*upnp.Action {
+	given := make(map[string]bool)
+	for _, aa := range m.ActionArgument {
+		given[aa.Name] = true
+	}
+
+	actions := make([]*upnp.Action, 0)
+	for _, la := range m.LabelActions {
+		service, ok := root.Services[la.serviceOf(m)]
+		if !ok {
+			v.report(where, "service %s of label action not found", la.serviceOf(m))
+			continue
+		}
+
+		action, ok := service.Actions[la.Action]
+		if !ok {
+			v.report(where, "label action %s not found in service %s", la.Action, la.serviceOf(m))
+			continue
+		}
+
+		for _, arg := range action.Arguments {
+			if arg.Direction == "in" && !given[arg.Name] {
+				v.report(where, "label action %s requires input argument %s, which is not given for the metric", la.Action, arg.Name)
+			}
+		}
+
+		actions = append(actions, action)
+	}
+
+	return actions
+}
+
+// isLabelActionResult checks if a label action returns the state variable
+func isLabelActionResult(actions []*upnp.Action, stateVar string) bool {
+	for _, a := range actions {
+		if arg := stateVarArgument(a, stateVar); arg != nil && arg.Direction == "out" {
+			return true
+		}
+	}
+	return false
+}
+
+// isProviderResult checks if a provider action of the metric returns the state variable
+func isProviderResult(m *Metric, service *upnp.Service, stateVar string) bool {
+	for _, aa := range m.ActionArgument {
+		if provider, ok := service.Actions[aa.ProviderAction]; ok {
+			if arg := stateVarArgument(provider, stateVar); arg != nil && arg.Direction == "out" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (v *validator) validateMetricsFile(file string, root *upnp.Root) {
+	var metrics []*Metric
+	data, offsets, ok := v.readMetricFile(file, &metrics, "")
+	if !ok {
+		return
+	}
+
+	for i, m := range metrics {
+		v.checkMetric(position(file, data, offsets[i]), m, root)
+	}
+}
+
+func (v *validator) checkLuaMetric(where string, lm *LuaMetric) {
+	if lm.Path == "" || lm.ResultKey == "" {
+		v.report(where, "path and resultKey are required")
+		return
+	}
+
+	pathParts := strings.SplitN(lm.Path, ":", 2)
+	if len(pathParts) > 1 && pathParts[0] != "GET" && pathParts[0] != "POST" {
+		v.report(where, "method %s is unsupported in path %s", pathParts[0], lm.Path)
+	}
+
+	v.checkPromType(where, lm.PromType)
+	v.checkPromDesc(where, &lm.PromDesc, lm.PromType)
+	v.checkTransform(where, lm.Transform, lm.OkValue)
+	v.checkValueOptions(where, lm.PromType, lm.States, lm.Transform, lm.OkValue)
+}
+
+func (v *validator) validateLuaMetricsFile(file string) {
+	var lmf LuaMetricsFile
+	data, offsets, ok := v.readMetricFile(file, &lmf, "metrics")
+	if !ok {
+		return
+	}
+
+	for i, lm := range lmf.Metrics {
+		v.checkLuaMetric(position(file, data, offsets[i]), lm)
+	}
+
+	offsets, err := elementOffsets(data, "labelRenames")
+	if err != nil {
+		v.report(file, "%s", err.Error())
+		return
+	}
+
+	for i, ren := range lmf.LabelRenames {
+		_, err := regexp.Compile(ren.MatchRegex)
+		if err != nil {
+			v.report(position(file, data, offsets[i]), "invalid regex in labelRenames: %s", err.Error())
+		}
+	}
+}
+
+// loadValidationServices loads the services of the target or from the services file
+func (v *validator) loadValidationServices(tc *TargetConfig) *upnp.Root {
+	var root *upnp.Root
+	var err error
+
+	if *flagServicesFile != "" {
+		root, err = upnp.LoadServicesFromFile(*flagServicesFile, tc.GatewayURL, tc.username, tc.password, tc.client)
+	} else {
+		root, err = upnp.LoadServicesWithClient(tc.GatewayURL, tc.username, tc.password, tc.client)
+	}
+
+	if err != nil {
+		v.report(tc.fieldPrefix(), "cannot load services, skipping checks against services: %s", err.Error())
+		return nil
+	}
+
+	if *flagServicesOut != "" && *flagServicesFile == "" {
+		err = root.SaveServices(*flagServicesOut)
+		if err != nil {
+			v.report(*flagServicesOut, "%s", err.Error())
+		}
+	}
+
+	return root
+}
+
+// validateMetrics validates the metric files of all targets and prints all problems found
+func validateMetrics(targets []*TargetConfig) bool {
+	v := &validator{}
+	validated := make(map[string]bool)
+
+	for _, tc := range targets {
+		var upnpFile, luaFile string
+		if tc.hasCollector(collectorUpnp) {
+			upnpFile = tc.MetricsFile
+		}
+		if tc.hasCollector(collectorLua) {
+			luaFile = tc.LuaMetricsFile
+		}
+
+		// with services from the box each target may be different
+		key := upnpFile + "|" + luaFile
+		if *flagServicesFile == "" && upnpFile != "" {
+			key += "|" + tc.Name
+		}
+		if validated[key] {
+			continue
+		}
+		validated[key] = true
+
+		// metric names must be consistent for all metrics of a target
+		v.families = make(map[string]*metricFamilyDef)
+
+		if upnpFile != "" {
+			root := v.loadValidationServices(tc)
+			v.validateMetricsFile(upnpFile, root)
+		}
+
+		if luaFile != "" {
+			v.validateLuaMetricsFile(luaFile)
+		}
+	}
+
+	if v.problems > 0 {
+		fmt.Printf("%d problems found\n", v.problems)
+		return false
+	}
+
+	fmt.Println("no problems found")
+	return true
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// prefix of the WLAN services, one instance per radio and one for the guest network
+	wlanServicePrefix = "urn:dslforum-org:service:WLANConfiguration:"
+
+	// TTL of the WLAN settings and stations
+	wlanTTL = minCacheTTL
+)
+
+// bands by the frequency band reported in GetInfo
+var wlanBands = map[string]string{
+	"2400": "2.4 GHz",
+	"5000": "5 GHz",
+	"6000": "6 GHz",
+}
+
+var wlanLabels = []string{"gateway", "band", "ssid"}
+
+var (
+	wlanInfoDesc = prometheus.NewDesc(
+		"gateway_wlan_info",
+		"WLAN of the FRITZ!Box with its standard and BSSID, value is always 1.",
+		[]string{"gateway", "band", "ssid", "standard", "bssid"},
+		nil,
+	)
+	wlanStatusDesc = prometheus.NewDesc(
+		"gateway_wlan_status",
+		"WLAN status (Enabled = 1)",
+		wlanLabels,
+		nil,
+	)
+	wlanConnectionsDesc = prometheus.NewDesc(
+		"gateway_wlan_current_connections",
+		"current WLAN connections",
+		wlanLabels,
+		nil,
+	)
+	wlanChannelDesc = prometheus.NewDesc(
+		"gateway_wlan_channel",
+		"Channel used by the WLAN.",
+		wlanLabels,
+		nil,
+	)
+	wlanNoiseDesc = prometheus.NewDesc(
+		"gateway_wlan_noise_dbm",
+		"Noise level of the WLAN radio.",
+		wlanLabels,
+		nil,
+	)
+	wlanStationSignalDesc = prometheus.NewDesc(
+		"gateway_wlan_station_signal_strength",
+		"Signal strength of the associated station as reported by the FRITZ!Box.",
+		[]string{"gateway", "band", "ssid", "mac", "ip"},
+		nil,
+	)
+	wlanStationRateDesc = prometheus.NewDesc(
+		"gateway_wlan_station_rate_bytes_per_second",
+		"Current PHY rate of the associated station by direction (down is sent to the station).",
+		[]string{"gateway", "band", "ssid", "mac", "ip", "direction"},
+		nil,
+	)
+)
+
+// wlanDeviceList document returned by the URL of X_AVM-DE_GetWLANDeviceListPath
+type wlanDeviceList struct {
+	Items []*wlanDevice `xml:"Item"`
+}
+
+type wlanDevice struct {
+	MACAddress     string `xml:"AssociatedDeviceMACAddress"`
+	IPAddress      string `xml:"AssociatedDeviceIPAddress"`
+	SignalStrength string `xml:"X_AVM-DE_SignalStrength"`
+	Speed          string `xml:"X_AVM-DE_Speed"`   // Mbit/s
+	SpeedRX        string `xml:"X_AVM-DE_SpeedRX"` // Mbit/s, not sent by all versions
+}
+
+// wlanCollector reports the WLANs of all WLANConfiguration services with their associated stations
+type wlanCollector struct{}
+
+func newWLANCollector() subCollector {
+	return &wlanCollector{}
+}
+
+func (wc *wlanCollector) collect(fc *FritzboxCollector, sc *scrape, ch chan<- prometheus.Metric) {
+	for _, service := range wlanServices(fc) {
+		wc.collectService(fc, sc, ch, service)
+	}
+}
+
+// wlanServices returns the WLAN services in order of their instance
+func wlanServices(fc *FritzboxCollector) []string {
+	fc.Lock()
+	root := fc.Root
+	fc.Unlock()
+
+	var services []string
+	for serviceType := range root.Services {
+		if strings.HasPrefix(serviceType, wlanServicePrefix) {
+			services = append(services, serviceType)
+		}
+	}
+
+	sort.Slice(services, func(i, j int) bool {
+		ni, _ := strconv.Atoi(strings.TrimPrefix(services[i], wlanServicePrefix))
+		nj, _ := strconv.Atoi(strings.TrimPrefix(services[j], wlanServicePrefix))
+		return ni < nj
+	})
+
+	return services
+}
+
+func (wc *wlanCollector) collectService(fc *FritzboxCollector, sc *scrape, ch chan<- prometheus.Metric, service string) {
+	result, err := fc.getActionResult(sc, service, "GetInfo", wlanTTL)
+	if err != nil {
+		logCollectError("WLAN info of "+service, err)
+		return
+	}
+	info := fc.argumentResults(service, "GetInfo", result)
+
+	ssid := sanitizeLabelValue(formatResult(info["SSID"]))
+	band := wlanBand(info)
+	labels := []string{fc.Gateway, band, ssid}
+
+	ch <- prometheus.MustNewConstMetric(wlanInfoDesc, prometheus.GaugeValue, 1, fc.Gateway, band, ssid,
+		sanitizeLabelValue(formatResult(info["Standard"])), strings.ToLower(formatResult(info["BSSID"])))
+
+	if status, err := resultValue(info["Status"], "Up"); err == nil {
+		ch <- prometheus.MustNewConstMetric(wlanStatusDesc, prometheus.GaugeValue, status, labels...)
+	} else {
+		logCollectError("WLAN status of "+service, err)
+	}
+
+	if channel, err := resultValue(info["Channel"], ""); err == nil {
+		ch <- prometheus.MustNewConstMetric(wlanChannelDesc, prometheus.GaugeValue, channel, labels...)
+	}
+
+	// the noise is only returned by some versions
+	if noise, ok := info["X_AVM-DE_Noise"]; ok {
+		if value, err := resultValue(noise, ""); err == nil {
+			ch <- prometheus.MustNewConstMetric(wlanNoiseDesc, prometheus.GaugeValue, value, labels...)
+		}
+	}
+
+	result, err = fc.getActionResult(sc, service, "GetTotalAssociations", wlanTTL)
+	if err != nil {
+		logCollectError("WLAN associations of "+service, err)
+	} else if associations, err := resultValue(result["TotalAssociations"], ""); err == nil {
+		ch <- prometheus.MustNewConstMetric(wlanConnectionsDesc, prometheus.GaugeValue, associations, labels...)
+
+		// no need to load the empty device list
+		if associations == 0 {
+			return
+		}
+	}
+
+	doc, err := fc.getDocument(sc, service, "X_AVM-DE_GetWLANDeviceListPath", "X_AVM-DE_WLANDeviceListPath", wlanTTL)
+	if err != nil {
+		logCollectError("WLAN stations of "+service, err)
+		return
+	}
+
+	var list wlanDeviceList
+	err = xml.Unmarshal(doc, &list)
+	if err != nil {
+		err = fmt.Errorf("error parsing WLAN device list: %w", err)
+		sc.stats.record(service, "X_AVM-DE_GetWLANDeviceListPath", 0, err, causeParse)
+		logCollectError("WLAN stations of "+service, err)
+		return
+	}
+
+	for _, d := range list.Items {
+		stationLabels := append(labels, strings.ToLower(d.MACAddress), d.IPAddress)
+
+		if signal, err := resultValue(d.SignalStrength, ""); err == nil {
+			ch <- prometheus.MustNewConstMetric(wlanStationSignalDesc, prometheus.GaugeValue, signal, stationLabels...)
+		}
+
+		for _, rate := range [][2]string{{d.Speed, "down"}, {d.SpeedRX, "up"}} {
+			if speed, err := resultValue(rate[0], ""); err == nil {
+				ch <- prometheus.MustNewConstMetric(wlanStationRateDesc, prometheus.GaugeValue, speed*unitFactors["Mbit/s"], append(stationLabels, rate[1])...)
+			}
+		}
+	}
+}
+
+// wlanBand returns the band of the frequency band or derived from the channel for versions without it
+func wlanBand(info map[string]interface{}) string {
+	if band, ok := wlanBands[formatResult(info["X_AVM-DE_FrequencyBand"])]; ok {
+		return band
+	}
+
+	channel, err := resultValue(info["Channel"], "")
+	switch {
+	case err != nil || channel == 0:
+		return "unknown"
+	case channel <= 14:
+		return wlanBands["2400"]
+	default:
+		return wlanBands["5000"]
+	}
+}